@@ -10,7 +10,6 @@ import (
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
-	"os"
 	"time"
 )
 
@@ -37,8 +36,20 @@ func init() {
 func main() {
 	flag.Parse()
 
-	// cleanup logs dir
-	os.RemoveAll(process.LogsDir)
+	// invalid logs limits would silently leave the logs unlimited
+	if err := process.CheckLogsFlags(); err != nil {
+		log.Fatalf("Logs flags are not valid. %s", err.Error())
+	}
+
+	// secrets must be known before any process output is recorded
+	if err := process.LoadSecrets(); err != nil {
+		log.Fatalf("Couldn't load secrets. %s", err.Error())
+	}
+
+	// restore processes registered by the previous agent run
+	if err := process.LoadProcesses(); err != nil {
+		log.Printf("Couldn't load processes registry. %s", err.Error())
+	}
 
 	router := mux.NewRouter().StrictSlash(true)
 	fmt.Print("⇩ Registered HttpRoutes:\n\n")
@@ -0,0 +1,152 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Returned when the native process which is going to be adopted doesn't exist
+type NoNativeProcessError struct {
+	NativePid int
+}
+
+func (err *NoNativeProcessError) Error() string {
+	return fmt.Sprintf("Native process with id '%d' doesn't exist", err.NativePid)
+}
+
+// Returned when the native process which is going to be adopted is already registered
+type AdoptedError struct {
+	NativePid int
+	Pid       uint64
+}
+
+func (err *AdoptedError) Error() string {
+	return fmt.Sprintf("Native process '%d' is already registered as process '%d'", err.NativePid, err.Pid)
+}
+
+// Returned when the native process can't be adopted e.g. its id is not valid
+type BadAdoptionError struct {
+	Message string
+}
+
+func (err *BadAdoptionError) Error() string {
+	return err.Message
+}
+
+// Registers the native process which is not started by the agent as a machine process.
+// The output of the adopted process is not captured, its liveness is tracked by polling.
+// If the subscriber is not nil then it is added before the process is registered
+func AdoptProcess(nativePid int, name string, processType string, subscriber *Subscriber) (*MachineProcess, error) {
+	if nativePid <= 0 {
+		return nil, &BadAdoptionError{"Required 'nativePid' to be > 0"}
+	}
+
+	// The init process leads its own process group, signaling
+	// the group of the init process would signal all the processes
+	if nativePid == 1 {
+		return nil, &BadAdoptionError{"The init process can't be adopted"}
+	}
+	if nativePid == os.Getpid() {
+		return nil, &BadAdoptionError{"The agent can't adopt itself"}
+	}
+	if p, ok := GetByNativePid(nativePid); ok {
+		return nil, &AdoptedError{nativePid, p.Pid}
+	}
+	stat, err := readProcStat(nativePid)
+	if err != nil || stat.State == "Z" {
+		return nil, &NoNativeProcessError{nativePid}
+	}
+	bootTime, err := readBootTime()
+	if err != nil {
+		return nil, err
+	}
+	args, err := readProcCmdline(nativePid)
+	if err != nil {
+		return nil, &NoNativeProcessError{nativePid}
+	}
+
+	commandLine := strings.Join(args, " ")
+	if commandLine == "" {
+		commandLine = "[" + stat.Comm + "]"
+	}
+	if name == "" {
+		name = stat.Comm
+	}
+
+	pid := atomic.AddUint64(&prevPid, 1)
+	filename, logs, err := newProcessLogger(pid, nil)
+	if err != nil {
+		releasePid(pid)
+		return nil, err
+	}
+	mp := &MachineProcess{
+		Pid:         pid,
+		Name:        name,
+		CommandLine: commandLine,
+		Type:        processType,
+		Alive:       true,
+		Adopted:     true,
+		NativePid:   nativePid,
+		StartTime:   procStartTime(bootTime, stat.StartTime),
+		logfileName: filename,
+		logs:        logs,
+		lastUsed:    time.Now(),
+	}
+	if subscriber != nil {
+		mp.subs = append(mp.subs, subscriber)
+	}
+
+	// The native process may be adopted concurrently, so it is checked again
+	// in the same critical section which registers the process
+	processes.Lock()
+	if p, ok := findByNativePid(nativePid); ok {
+		processes.Unlock()
+		logs.Close()
+		removeLogs(filename)
+		releasePid(pid)
+		return nil, &AdoptedError{nativePid, p.Pid}
+	}
+	processes.items[pid] = mp
+	processes.Unlock()
+	mp.persist()
+
+	go mp.watchAdopted()
+	go mp.publishStats()
+	return mp, nil
+}
+
+// Returns the pid which signals are sent to. It is the process group of the process,
+// or the process itself if the process is adopted and it doesn't lead its process group
+func (mp *MachineProcess) signalPid() int {
+	if mp.Adopted && !isGroupLeader(mp.NativePid) {
+		return mp.NativePid
+	}
+	return -mp.NativePid
+}
+
+// Sends the signal to the signal pid. The native process which is not a child
+// of the agent may finish and its pid may be reused at any moment, so its start
+// time is checked right before the signal is sent, NotAliveError is returned
+// if the pid belongs to another process. Must be called with the process mutex held
+func (mp *MachineProcess) signal(sig syscall.Signal) error {
+	if mp.command == nil && !isSameNativeProcess(mp.NativePid, mp.StartTime, !mp.Adopted) {
+		return &NotAliveError{mp.Pid}
+	}
+
+	// -1 means all the processes which the agent is permitted to signal
+	pid := mp.signalPid()
+	if pid == -1 {
+		return errors.New(fmt.Sprintf("Process with id '%d' can't be signaled, its signal pid is -1", mp.Pid))
+	}
+	return syscall.Kill(pid, sig)
+}
+
+func isGroupLeader(nativePid int) bool {
+	stat, err := readProcStat(nativePid)
+	return err == nil && stat.Pgrp == nativePid
+}
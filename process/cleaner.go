@@ -4,17 +4,44 @@ import (
 	"flag"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 )
 
 var (
 	periodInMinutesFlag           int
 	cleanupThresholdInMinutesFlag int
+	logsBudgetFlag                int64
+	maxDeadProcessesFlag          int
+
+	// Serializes cleanups, so the same process is not removed twice
+	cleanupMutex sync.Mutex
 )
 
+// Removes dead processes with their logs. The processes which are kept
+// are never removed by the cleaner, the others are removed from the oldest used one
+// if they are not used longer than the threshold, if there are more dead processes
+// than allowed or if the logs dir is larger than the budget
 type Cleaner struct {
 	period    time.Duration
 	threshold time.Duration
+
+	// The maximum size of the logs dir(in bytes), 0 means no limit
+	logsBudget int64
+
+	// The maximum number of dead processes which are not kept, 0 means no limit
+	maxDead int
+}
+
+// Describes which processes are removed by the cleanup
+type CleanupReport struct {
+	// The ids of the removed processes
+	Removed []uint64 `json:"removed"`
+
+	// The size of the removed logs(in bytes)
+	Freed int64 `json:"freed"`
 }
 
 func init() {
@@ -24,32 +51,144 @@ func init() {
 		"How often processs cleanup will happen(in minutes)")
 	flag.IntVar(&cleanupThresholdInMinutesFlag, "process-lifetime", 60,
 		`How much time will dead and unused process live(in minutes),
-		if -1 passed then processes won't be cleaned at all`)
+		if -1 passed then processes won't be cleaned because of their lifetime`)
+	flag.Int64Var(&logsBudgetFlag, "process-logs-budget", 0,
+		`The maximum size of the logs dir(in bytes), when it is exceeded the dead processes
+		are removed with their logs starting from the oldest used one. 0 means no limit`)
+	flag.IntVar(&maxDeadProcessesFlag, "process-max-dead", 0,
+		`The maximum number of dead processes which are not kept, when it is exceeded
+		the dead processes are removed starting from the oldest used one. 0 means no limit`)
 }
 
 func (c *Cleaner) CleanupDeadUnusedProcesses() {
-	if c.threshold >= 0 {
+	if c.threshold >= 0 || c.logsBudget > 0 || c.maxDead > 0 {
 		ticker := time.NewTicker(c.period)
 		defer ticker.Stop()
 		for range ticker.C {
-			deadPoint := time.Now().Add(-c.threshold)
-			processes.Lock()
-			for _, v := range processes.items {
-				if !v.Alive && v.lastUsed.Before(deadPoint) {
-					delete(processes.items, v.Pid)
-					if err := os.Remove(v.logfileName); err != nil {
-						log.Printf("Couldn't remove process logs file, '%s'", v.logfileName)
-					}
-				}
-			}
-			processes.Unlock()
+			c.Cleanup()
+		}
+	}
+}
+
+// Removes the dead processes according to the cleaner policies
+func (c *Cleaner) Cleanup() *CleanupReport {
+	cleanupMutex.Lock()
+	defer cleanupMutex.Unlock()
+
+	// The candidates are ordered from the oldest used one,
+	// the kept processes are not counted as dead ones
+	candidates := []*MachineProcess{}
+	for _, p := range GetProcesses(true) {
+		p.mutex.RLock()
+		if !p.Alive && !p.Keep {
+			candidates = append(candidates, p)
 		}
+		p.mutex.RUnlock()
 	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsedTime().Before(candidates[j].lastUsedTime())
+	})
+
+	logsSize := int64(0)
+	if c.logsBudget > 0 {
+		logsSize = dirSize(LogsDir)
+	}
+	deadPoint := time.Now().Add(-c.threshold)
+	report := &CleanupReport{Removed: []uint64{}}
+	dead := len(candidates)
+	for _, p := range candidates {
+		expired := c.threshold >= 0 && p.lastUsedTime().Before(deadPoint)
+		tooMany := c.maxDead > 0 && dead > c.maxDead
+		overBudget := c.logsBudget > 0 && logsSize > c.logsBudget
+		if !expired && !tooMany && !overBudget {
+			continue
+		}
+		freed, err := p.Discard()
+		if err != nil {
+			continue
+		}
+		dead--
+		logsSize -= freed
+		report.Removed = append(report.Removed, p.Pid)
+		report.Freed += freed
+	}
+	return report
 }
 
 func NewCleaner() *Cleaner {
 	return &Cleaner{
-		period:    time.Duration(periodInMinutesFlag) * time.Minute,
-		threshold: time.Duration(cleanupThresholdInMinutesFlag) * time.Minute,
+		period:     time.Duration(periodInMinutesFlag) * time.Minute,
+		threshold:  time.Duration(cleanupThresholdInMinutesFlag) * time.Minute,
+		logsBudget: logsBudgetFlag,
+		maxDead:    maxDeadProcessesFlag,
 	}
 }
+
+// Removes the dead process with its logs, even if the process is kept.
+// Returns the size of the removed logs or AliveError if the process is alive
+func (mp *MachineProcess) Discard() (int64, error) {
+	mp.mutex.Lock()
+	if mp.Alive {
+		mp.mutex.Unlock()
+		return 0, &AliveError{mp.Pid}
+	}
+
+	// The logs kept in memory are released as well
+	mp.logs = nil
+	mp.mutex.Unlock()
+
+	processes.Lock()
+	_, ok := processes.items[mp.Pid]
+	delete(processes.items, mp.Pid)
+	processes.Unlock()
+
+	// The process is already discarded
+	if !ok {
+		return 0, nil
+	}
+	removeRecord(mp.Pid)
+	size := logsSize(mp.logfileName)
+	if err := removeLogs(mp.logfileName); err != nil {
+		log.Printf("Couldn't remove process logs file, '%s'", mp.logfileName)
+	}
+	return size, nil
+}
+
+// Sets whether the process is kept by the cleaner after it is dead
+func (mp *MachineProcess) SetKeep(keep bool) {
+	mp.mutex.Lock()
+	mp.Keep = keep
+	mp.lastUsed = time.Now()
+	mp.mutex.Unlock()
+	mp.persist()
+}
+
+func (mp *MachineProcess) lastUsedTime() time.Time {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+	return mp.lastUsed
+}
+
+// Returns the size of the logs file with all its segments and indexes
+func logsSize(filename string) int64 {
+	names, _ := filepath.Glob(filename + ".*")
+	size := int64(0)
+	for _, name := range append(names, filename) {
+		if info, err := os.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// Returns the size of all the files in the dir and its subdirectories
+func dirSize(dir string) int64 {
+	size := int64(0)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,116 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	DefaultShell = "sh"
+
+	MergeEnvMode   = "merge"
+	ReplaceEnvMode = "replace"
+)
+
+// Creates an executable command from the given machine command.
+// The command is always started in a new session to be able to kill
+// child processes, see https://github.com/golang/go/issues/8854.
+// The session is created by the forked child before the command is executed
+// instead of wrapping the command with the 'setsid' binary. Unlike the wrapper it
+// guarantees that the process group exists as soon as the command is started,
+// so the group may be suspended or killed right away, it doesn't require util-linux
+// to be installed, and the terminal can be made the controlling one of the session.
+// If the command defines the user or groups then it is run with their credential
+func newExecCmd(command Command) (*exec.Cmd, error) {
+	credential, user, err := commandCredential(command)
+	if err != nil {
+		return nil, err
+	}
+
+	args := command.Argv
+	if len(args) == 0 {
+		shell := command.Shell
+		if shell == "" {
+			shell = DefaultShell
+		}
+		args = []string{shell, "-c", command.CommandLine}
+	}
+
+	// Rlimits must be set before the command is executed, so the command
+	// is wrapped with a shell which sets them and replaces itself with the command
+	if script := ulimitScript(command.Limits); script != "" {
+		args = append([]string{DefaultShell, "-c", script + " && exec \"$@\"", DefaultShell}, args...)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = command.WorkingDir
+	cmd.Env = commandEnv(command, user)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:     true,
+		Credential: credential,
+	}
+	return cmd, nil
+}
+
+// Returns the shell script which applies rlimits e.g. 'ulimit -n 1024 && ulimit -c 0'.
+// If there is nothing to limit with rlimits then an empty string is returned
+func ulimitScript(limits *ResourceLimits) string {
+	if limits == nil {
+		return ""
+	}
+	commands := []string{}
+	if limits.OpenFiles > 0 {
+		commands = append(commands, fmt.Sprintf("ulimit -n %d", limits.OpenFiles))
+	}
+	if limits.CoreSize != nil {
+		// The core size is set in 512-byte blocks
+		commands = append(commands, fmt.Sprintf("ulimit -c %d", (*limits.CoreSize+511)/512))
+	}
+	return strings.Join(commands, " && ")
+}
+
+// Returns the environment of the command in the 'key=value' form.
+// If the command doesn't define any environment variables, it is not run
+// as another user and mode is not 'replace', then nil is returned, which means
+// that the agent's environment is used. If the command is run as another user then
+// HOME, USER and LOGNAME variables describe that user unless the command overrides them
+func commandEnv(command Command, user *passwdEntry) []string {
+	if len(command.Env) == 0 && user == nil && command.EnvMode != ReplaceEnvMode {
+		return nil
+	}
+
+	vars := make(map[string]string, len(command.Env)+3)
+	if user != nil {
+		vars["HOME"] = user.Home
+		vars["USER"] = user.Name
+		vars["LOGNAME"] = user.Name
+	}
+	for key, value := range command.Env {
+		vars[key] = value
+	}
+
+	env := []string{}
+	if command.EnvMode != ReplaceEnvMode {
+		for _, kv := range os.Environ() {
+			key := strings.SplitN(kv, "=", 2)[0]
+			if _, ok := vars[key]; !ok {
+				env = append(env, kv)
+			}
+		}
+	}
+
+	// Sort the keys to keep the environment order stable
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+vars[key])
+	}
+	return env
+}
@@ -0,0 +1,276 @@
+package process
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+
+	allowedUsersFlag  string
+	allowedGroupsFlag string
+)
+
+// The user entry of /etc/passwd
+type passwdEntry struct {
+	Name string
+	Uid  uint32
+	Gid  uint32
+	Home string
+}
+
+// The group entry of /etc/group
+type groupEntry struct {
+	Name    string
+	Gid     uint32
+	Members []string
+}
+
+func init() {
+	flag.StringVar(&allowedUsersFlag, "allowed-users", "",
+		`Comma separated names of the users which processes may be run as,
+		if not specified then processes may be run as any user`)
+	flag.StringVar(&allowedGroupsFlag, "allowed-groups", "",
+		`Comma separated names of the groups which processes may be run with
+		besides the groups of the user which the process is run as`)
+}
+
+// Returns the credential which the command is run with,
+// nil is returned if the command defines neither user nor groups.
+// If the command defines the user then the user entry is returned as well
+func commandCredential(command Command) (*syscall.Credential, *passwdEntry, error) {
+	if command.User == "" && command.Group == "" && len(command.Groups) == 0 {
+		return nil, nil, nil
+	}
+
+	credential := &syscall.Credential{
+		Uid:         uint32(os.Getuid()),
+		Gid:         uint32(os.Getgid()),
+		NoSetGroups: true,
+	}
+	var user *passwdEntry
+	if command.User != "" {
+		var err error
+		if user, err = lookupUser(command.User); err != nil {
+			return nil, nil, err
+		}
+		credential.Uid = user.Uid
+		credential.Gid = user.Gid
+
+		// The user is a member of its groups as it would be after login
+		groups, err := memberGroups(user)
+		if err != nil {
+			return nil, nil, err
+		}
+		credential.NoSetGroups = false
+		credential.Groups = []uint32{}
+		for _, group := range groups {
+			if group.Gid != user.Gid {
+				credential.Groups = append(credential.Groups, group.Gid)
+			}
+		}
+	}
+	if command.Group != "" {
+		group, err := lookupGroup(command.Group)
+		if err != nil {
+			return nil, nil, err
+		}
+		credential.Gid = group.Gid
+	}
+	if len(command.Groups) != 0 {
+		credential.NoSetGroups = false
+		credential.Groups = make([]uint32, 0, len(command.Groups))
+		for _, name := range command.Groups {
+			group, err := lookupGroup(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			credential.Groups = append(credential.Groups, group.Gid)
+		}
+	}
+	return credential, user, nil
+}
+
+// Checks whether the command may be run with the requested user and groups
+func checkCredential(command *Command) error {
+	credential, user, err := commandCredential(*command)
+	if err != nil || credential == nil {
+		return err
+	}
+	if user != nil && allowedUsersFlag != "" && !isListed(allowedUsersFlag, user.Name) {
+		return errors.New(fmt.Sprintf("Running processes as user '%s' is not allowed", user.Name))
+	}
+	if err := checkGroups(command, user); err != nil {
+		return err
+	}
+
+	// Only privileged agent can change the credential
+	if os.Geteuid() != 0 {
+		if credential.Uid != uint32(os.Geteuid()) || credential.Gid != uint32(os.Getegid()) || !credential.NoSetGroups {
+			return errors.New("Running processes as another user or group requires the agent to be run as root")
+		}
+	}
+	return nil
+}
+
+// Checks whether the groups requested by the command are either the groups of the user,
+// which is the agent's user if the command doesn't define one, or allowed by the -allowed-groups flag
+func checkGroups(command *Command, user *passwdEntry) error {
+	names := command.Groups
+	if command.Group != "" {
+		names = append([]string{command.Group}, names...)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if user == nil {
+		// The agent's user may be missing in /etc/passwd, then only the allowed groups are available
+		user, _ = lookupUser(strconv.Itoa(os.Getuid()))
+	}
+	own := map[uint32]bool{}
+	if user != nil {
+		own[user.Gid] = true
+		groups, err := memberGroups(user)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			own[group.Gid] = true
+		}
+	}
+	for _, name := range names {
+		group, err := lookupGroup(name)
+		if err != nil {
+			return err
+		}
+		if !own[group.Gid] && !isListed(allowedGroupsFlag, group.Name, strconv.FormatUint(uint64(group.Gid), 10)) {
+			return errors.New(fmt.Sprintf("Running processes with group '%s' is not allowed", group.Name))
+		}
+	}
+	return nil
+}
+
+// Returns true if any of the names is in the comma separated list
+func isListed(list string, names ...string) bool {
+	for _, listed := range strings.Split(list, ",") {
+		for _, name := range names {
+			if strings.TrimSpace(listed) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the groups of /etc/group which the user is a member of
+func memberGroups(user *passwdEntry) ([]*groupEntry, error) {
+	groups, err := readGroups()
+	if err != nil {
+		return nil, err
+	}
+	member := []*groupEntry{}
+	for _, group := range groups {
+		for _, name := range group.Members {
+			if name == user.Name {
+				member = append(member, group)
+				break
+			}
+		}
+	}
+	return member, nil
+}
+
+// Finds the user by its name or numeric id in /etc/passwd
+func lookupUser(nameOrId string) (*passwdEntry, error) {
+	users := []*passwdEntry{}
+	err := readColonFile(passwdFile, 7, func(fields []string) error {
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			return err
+		}
+		users = append(users, &passwdEntry{
+			Name: fields[0],
+			Uid:  uint32(uid),
+			Gid:  uint32(gid),
+			Home: fields[5],
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.Name == nameOrId || strconv.FormatUint(uint64(user.Uid), 10) == nameOrId {
+			return user, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("User '%s' doesn't exist", nameOrId))
+}
+
+// Finds the group by its name or numeric id in /etc/group
+func lookupGroup(nameOrId string) (*groupEntry, error) {
+	groups, err := readGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if group.Name == nameOrId || strconv.FormatUint(uint64(group.Gid), 10) == nameOrId {
+			return group, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Group '%s' doesn't exist", nameOrId))
+}
+
+func readGroups() ([]*groupEntry, error) {
+	groups := []*groupEntry{}
+	err := readColonFile(groupFile, 4, func(fields []string) error {
+		gid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return err
+		}
+		group := &groupEntry{Name: fields[0], Gid: uint32(gid)}
+		if fields[3] != "" {
+			group.Members = strings.Split(fields[3], ",")
+		}
+		groups = append(groups, group)
+		return nil
+	})
+	return groups, err
+}
+
+// Reads the file which lines consist of the colon separated fields
+// like /etc/passwd, lines which are comments or have fewer fields are skipped
+func readColonFile(filename string, fieldsCount int, handle func(fields []string) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < fieldsCount {
+			continue
+		}
+		if err := handle(fields); err != nil {
+			return errors.New(fmt.Sprintf("Couldn't parse '%s' of %s. %s", line, filename, err.Error()))
+		}
+	}
+	return scanner.Err()
+}
@@ -1,11 +1,22 @@
 // TODO add subscribed event types
 package process
 
+import (
+	"time"
+)
+
 const (
-	ProcessStartedEventType = "process_started"
-	ProcessDiedEventType    = "process_died"
-	StdoutEventType         = "stdout"
-	StderrEventType         = "stderr"
+	ProcessStartedEventType      = "process_started"
+	ProcessDiedEventType         = "process_died"
+	ProcessPausedEventType       = "process_paused"
+	ProcessResumedEventType      = "process_resumed"
+	ProcessTimedOutEventType     = "process_timed_out"
+	ProcessRestartedEventType    = "process_restarted"
+	ProcessReadyEventType        = "process_ready"
+	ProcessReadyTimeoutEventType = "process_ready_timeout"
+	ProcessStatsEventType        = "process_stats"
+	StdoutEventType              = "stdout"
+	StderrEventType              = "stderr"
 )
 
 type ProcessEventBody struct {
@@ -14,12 +25,26 @@ type ProcessEventBody struct {
 
 type ProcessStatusEventBody struct {
 	ProcessEventBody
-	NativePid   int    `json:"nativePid"`
-	Name        string `json:"name"`
-	CommandLine string `json:"commandLine"`
+	NativePid   int       `json:"nativePid"`
+	Name        string    `json:"name"`
+	CommandLine string    `json:"commandLine"`
+	StartTime   time.Time `json:"startTime"`
+
+	// Present only in the process_died and process_restarted events,
+	// in the latter it describes the finish of the previous launch
+	Exit *ExitInfo `json:"exit,omitempty"`
+
+	// The number of the restart attempt, present only in the process_restarted event
+	Attempt int `json:"attempt,omitempty"`
 }
 
 type ProcessOutputEventBody struct {
 	ProcessEventBody
 	Text string `json:"text"`
+
+	// Present only if the line is not valid UTF-8, the text is base64 encoded then
+	Encoding string `json:"encoding,omitempty"`
+
+	// The sequence number of the line in the process output
+	Seq uint64 `json:"seq"`
 }
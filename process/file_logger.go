@@ -13,17 +13,61 @@ const (
 	flushThreshold = 8192
 )
 
+// Writes the logs to the indexed segments, see LogsStore.
+// Completed segments are compressed in background and the size of all the segments
+// is kept under the maximum size according to the limits policy
 type FileLogger struct {
 	sync.RWMutex
 	filename string
 	buffer   *bytes.Buffer
-	encoder  *json.Encoder
+	limits   *LogsLimits
+
+	// The buffered entries of the latest segment index
+	index *bytes.Buffer
+
+	// The size of the latest segment including the buffered lines
+	size int64
+
+	// The size of the latest segment when the last index entry was added
+	indexedSize int64
+
+	// The number of the segments which are completed
+	segments int
+
+	// The completed segments which are not dropped, from the earliest to the latest
+	completed []*completedSegment
+
+	// Awaits the segments which are being compressed
+	compressing sync.WaitGroup
+
+	// Whether the logs are not recorded any more as the maximum size is reached
+	stopped bool
+}
+
+// The completed segment of the logs
+type completedSegment struct {
+	number int
+
+	// The size of the segment on disk
+	size int64
 }
 
 func NewLogger(filename string) (*FileLogger, error) {
+	return NewLimitedLogger(filename, nil)
+}
+
+// Creates the logger which writes the logs with the given limits,
+// the agent defaults are used for the limits which are not specified
+func NewLimitedLogger(filename string, limits *LogsLimits) (*FileLogger, error) {
 	fl := &FileLogger{filename: filename}
 	fl.buffer = &bytes.Buffer{}
-	fl.encoder = json.NewEncoder(fl.buffer)
+	fl.index = &bytes.Buffer{}
+	fl.limits = effectiveLogsLimits(limits)
+
+	// The segments of the previous logs with the same name are not continued
+	if err := removeLogs(filename); err != nil {
+		return nil, err
+	}
 
 	// Trying to create logs file
 	file, err := os.Create(filename)
@@ -42,32 +86,191 @@ func (fl *FileLogger) Flush() {
 }
 
 func (fl *FileLogger) OnStdout(line string, time time.Time) {
-	fl.writeLine(&LogMessage{StdoutKind, time, line})
+	fl.Append(newLogMessage(StdoutKind, time, line))
 }
 
 func (fl *FileLogger) OnStderr(line string, time time.Time) {
-	fl.writeLine(&LogMessage{StderrKind, time, line})
+	fl.Append(newLogMessage(StderrKind, time, line))
 }
 
+// Flushes the logs and waits until the completed segments are compressed
 func (fl *FileLogger) Close() {
 	fl.Flush()
+	fl.compressing.Wait()
 }
 
-func (fl *FileLogger) writeLine(message *LogMessage) {
+func (fl *FileLogger) Append(message *LogMessage) bool {
 	fl.Lock()
-	fl.encoder.Encode(message)
+	defer fl.Unlock()
+	if fl.stopped {
+		return false
+	}
+	line, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Couldn't encode log message of '%s'. %s", fl.filename, err.Error())
+		return false
+	}
+	line = append(line, '\n')
+	if fl.exceedsMaxSize(len(line)) {
+		// The segments which are being compressed may free enough space
+		fl.Unlock()
+		fl.compressing.Wait()
+		fl.Lock()
+		if fl.exceedsMaxSize(len(line)) {
+			fl.stopped = true
+			log.Printf("Logs '%s' reached the maximum size %d, the rest of the logs is not recorded", fl.filename, fl.limits.MaxSize)
+			return false
+		}
+	}
+	if fl.size >= fl.limits.SegmentSize && fl.size > 0 {
+		fl.rotate()
+	}
+	if fl.size == 0 || fl.size-fl.indexedSize >= indexInterval {
+		fl.index.Write(encodeIndexEntry(indexEntry{message.Seq, message.Time, fl.size}))
+		fl.indexedSize = fl.size
+	}
+	fl.buffer.Write(line)
+	fl.size += int64(len(line))
 	if flushThreshold < fl.buffer.Len() {
 		fl.doFlush()
 	}
-	fl.Unlock()
+	return true
 }
 
-func (fl *FileLogger) doFlush() {
-	f, err := os.OpenFile(fl.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+// Returns true if the logs which stop at the maximum size can't be continued with the line
+func (fl *FileLogger) exceedsMaxSize(lineSize int) bool {
+	if fl.limits.MaxSize == 0 || fl.limits.Policy != StopLogsPolicy {
+		return false
+	}
+	size := fl.size + int64(lineSize)
+	for _, segment := range fl.completed {
+		size += segment.size
+	}
+	return size > fl.limits.MaxSize
+}
+
+func (fl *FileLogger) ReadForward(from time.Time, afterSeq uint64, handle func(message *LogMessage) bool) error {
+	segments, err := fl.openSegments()
+	if err != nil {
+		return err
+	}
+	defer closeSegments(segments)
+	return readForward(segments, from, afterSeq, handle)
+}
+
+func (fl *FileLogger) ReadBackward(till time.Time, handle func(message *LogMessage) bool) error {
+	segments, err := fl.openSegments()
 	if err != nil {
-		log.Printf("Couldn't open file '%s' for flushing the buffer. %s \n", fl.filename, err.Error())
+		return err
+	}
+	defer closeSegments(segments)
+	return readBackward(segments, till, handle)
+}
+
+// Flushes the logs and opens the segments, so they
+// are not renamed while they are being opened
+func (fl *FileLogger) openSegments() ([]*logSegment, error) {
+	fl.Lock()
+	defer fl.Unlock()
+	fl.doFlush()
+	return openSegments(fl.filename)
+}
+
+// Completes the latest segment and starts the next one
+func (fl *FileLogger) rotate() {
+	fl.doFlush()
+	completed := segmentName(fl.filename, fl.segments+1)
+	if err := os.Rename(fl.filename+indexSuffix, completed+indexSuffix); err != nil {
+		log.Printf("Couldn't rename logs index '%s'. %s", fl.filename+indexSuffix, err.Error())
+	}
+	if err := os.Rename(fl.filename, completed); err != nil {
+		log.Printf("Couldn't rename logs segment '%s'. %s", fl.filename, err.Error())
+		return
+	}
+	if file, err := os.Create(fl.filename); err != nil {
+		log.Printf("Couldn't create logs segment '%s'. %s", fl.filename, err.Error())
 	} else {
-		defer f.Close()
-		fl.buffer.WriteTo(f)
+		file.Close()
+	}
+	fl.segments++
+	fl.completed = append(fl.completed, &completedSegment{fl.segments, fl.size})
+	fl.size = 0
+	fl.indexedSize = 0
+
+	if fl.limits.MaxSize != 0 && fl.limits.Policy == DropOldestLogsPolicy {
+		fl.dropOldest()
+	}
+	if *fl.limits.Compress {
+		fl.compressing.Add(1)
+		go fl.compress(fl.segments)
+	}
+}
+
+// Removes the oldest completed segments, so the next segment fits the maximum size
+func (fl *FileLogger) dropOldest() {
+	size := fl.limits.SegmentSize
+	for _, segment := range fl.completed {
+		size += segment.size
+	}
+	for len(fl.completed) != 0 && size > fl.limits.MaxSize {
+		removeSegment(segmentName(fl.filename, fl.completed[0].number))
+		size -= fl.completed[0].size
+		fl.completed = fl.completed[1:]
+	}
+}
+
+// Compresses the completed segment, if the segment is dropped
+// while it is being compressed then the compressed segment is removed
+func (fl *FileLogger) compress(number int) {
+	defer fl.compressing.Done()
+	name := segmentName(fl.filename, number)
+	size, err := compressSegment(name)
+
+	fl.Lock()
+	defer fl.Unlock()
+	var segment *completedSegment
+	for _, completed := range fl.completed {
+		if completed.number == number {
+			segment = completed
+		}
+	}
+	if segment == nil {
+		removeSegment(name)
+		return
+	}
+	if err == nil {
+		err = replaceWithCompressed(name)
+	}
+	if err != nil {
+		log.Printf("Couldn't compress logs segment '%s'. %s", name, err.Error())
+		os.Remove(name + compressedSuffix + tmpSuffix)
+		os.Remove(name + compressedSuffix + indexSuffix + tmpSuffix)
+		return
+	}
+	segment.size = size
+}
+
+func (fl *FileLogger) doFlush() {
+	if fl.buffer.Len() != 0 {
+		if err := appendFile(fl.filename, fl.buffer); err != nil {
+			log.Printf("Couldn't open file '%s' for flushing the buffer. %s \n", fl.filename, err.Error())
+		}
+	}
+
+	// The index is written after the lines, so its entries always point to the written lines
+	if fl.index.Len() != 0 {
+		if err := appendFile(fl.filename+indexSuffix, fl.index); err != nil {
+			log.Printf("Couldn't open file '%s' for flushing the index. %s \n", fl.filename+indexSuffix, err.Error())
+		}
+	}
+}
+
+func appendFile(filename string, buffer *bytes.Buffer) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
+	_, err = buffer.WriteTo(f)
+	return err
 }
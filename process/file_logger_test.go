@@ -91,7 +91,7 @@ func TestLogsAreFlushedOnClose(t *testing.T) {
 		Time: now,
 		Text: "stdout",
 	}
-	if stdout != expectedStdout {
+	if !equalMessages(stdout, expectedStdout) {
 		t.Fatalf("Expected %v but found %v", expectedStdout, stdout)
 	}
 	expectedStderr := process.LogMessage{
@@ -99,11 +99,17 @@ func TestLogsAreFlushedOnClose(t *testing.T) {
 		Time: now,
 		Text: "stderr",
 	}
-	if stdout != expectedStdout {
+	if !equalMessages(stderr, expectedStderr) {
 		t.Fatalf("Expected %v but found %v", expectedStderr, stderr)
 	}
 }
 
+// Compares messages using time.Equal, as decoded time
+// keeps neither the monotonic clock reading nor the location
+func equalMessages(m1 process.LogMessage, m2 process.LogMessage) bool {
+	return m1.Kind == m2.Kind && m1.Text == m2.Text && m1.Time.Equal(m2.Time)
+}
+
 func randomName(length int) string {
 	rand.Seed(time.Now().UnixNano())
 	bytes := make([]byte, length)
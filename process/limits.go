@@ -0,0 +1,294 @@
+package process
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	cgroupMountDir = "/sys/fs/cgroup"
+
+	// The period of the cpu quota(in microseconds)
+	cpuPeriod = 100000
+
+	// How many times the removal of the cgroup is retried
+	// while the killed processes are leaving it
+	cgroupRemoveAttempts = 50
+
+	// The delay between the attempts to remove the cgroup
+	cgroupRemoveDelay = 20 * time.Millisecond
+)
+
+var (
+	cgroupDirFlag string
+
+	// Lazily detected cgroup v2 hierarchy used for limiting processes
+	cgroups = &cgroupsSupport{}
+)
+
+// Defines resources available for the process.
+// Zero value of any limit means that the resource is not limited
+type ResourceLimits struct {
+	// The maximum memory of the process group(in bytes).
+	// Requires cgroup
+	Memory int64 `json:"memory"`
+
+	// The number of cpus available for the process group e.g. 0.5.
+	// Requires cgroup
+	Cpu float64 `json:"cpu"`
+
+	// The maximum number of processes and threads in the process group.
+	// Requires cgroup
+	Pids int64 `json:"pids"`
+
+	// The maximum number of open files per process, applied with rlimit
+	OpenFiles uint64 `json:"openFiles"`
+
+	// The maximum size of core dumps(in bytes), applied with rlimit.
+	// Unlike the other limits 0 disables core dumps, not specified value means no limit
+	CoreSize *uint64 `json:"coreSize"`
+}
+
+// Describes cgroup v2 hierarchy which is used for limiting processes
+type cgroupsSupport struct {
+	once sync.Once
+
+	// The directory where process cgroups are created,
+	// empty if cgroups are not available
+	dir string
+
+	// Controllers enabled for process cgroups e.g. 'memory'
+	controllers map[string]bool
+}
+
+// A cgroup created for the certain process
+type processCgroup struct {
+	dir string
+}
+
+func init() {
+	flag.StringVar(&cgroupDirFlag, "cgroup-dir", "",
+		`Writable cgroup v2 directory where process cgroups are created,
+		if not specified then the directory is created in the agent's cgroup when possible`)
+}
+
+// Returns true if the given controller can be used for limiting processes
+func (cs *cgroupsSupport) has(controller string) bool {
+	cs.once.Do(cs.detect)
+	return cs.controllers[controller]
+}
+
+func (cs *cgroupsSupport) detect() {
+	cs.controllers = make(map[string]bool)
+	dir := cgroupDirFlag
+	if dir == "" {
+		agentCgroup, err := agentCgroupPath()
+		if err != nil {
+			log.Printf("Cgroup v2 is not available, processes may be limited with rlimits only. %s", err.Error())
+			return
+		}
+		dir = filepath.Join(cgroupMountDir, agentCgroup, "machine-agent")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Couldn't create cgroup directory '%s'. %s", dir, err.Error())
+		return
+	}
+
+	// Controllers must be enabled in the parent to be available in
+	// the created directory, enabling may fail e.g. when the parent is not
+	// a root cgroup and contains processes, which is fine if controllers are already enabled
+	for _, controller := range []string{"memory", "cpu", "pids"} {
+		enableController(filepath.Dir(dir), controller)
+		enableController(dir, controller)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		log.Printf("Couldn't read cgroup controllers of '%s'. %s", dir, err.Error())
+		return
+	}
+	for _, controller := range strings.Fields(string(content)) {
+		cs.controllers[controller] = true
+	}
+	cs.dir = dir
+}
+
+// Creates a cgroup for the process with the given pid and applies the limits to it.
+// Returns nil if none of the limits requires cgroup
+func newProcessCgroup(pid uint64, limits *ResourceLimits) (*processCgroup, error) {
+	if limits == nil || (limits.Memory == 0 && limits.Cpu == 0 && limits.Pids == 0) {
+		return nil, nil
+	}
+
+	cg := &processCgroup{dir: filepath.Join(cgroups.dir, fmt.Sprintf("pid-%d", pid))}
+	if err := os.Mkdir(cg.dir, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	if limits.Memory > 0 {
+		if err := cg.write("memory.max", strconv.FormatInt(limits.Memory, 10)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	if limits.Cpu > 0 {
+		quota := int64(limits.Cpu * cpuPeriod)
+		if err := cg.write("cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	if limits.Pids > 0 {
+		if err := cg.write("pids.max", strconv.FormatInt(limits.Pids, 10)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	return cg, nil
+}
+
+// Returns true if any process of this cgroup was killed by OOM killer
+func (cg *processCgroup) oomKilled() bool {
+	return cg.readEvent("memory.events", "oom_kill") > 0
+}
+
+// Returns true if the processes of this cgroup failed to fork because of the pids limit
+func (cg *processCgroup) pidsLimited() bool {
+	return cg.readEvent("pids.events", "max") > 0
+}
+
+// Returns the counter of the event from the cgroup events file e.g. 'oom_kill' of 'memory.events',
+// 0 if the file or the event doesn't exist
+func (cg *processCgroup) readEvent(file string, event string) int {
+	f, err := os.Open(filepath.Join(cg.dir, file))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == event {
+			count, _ := strconv.Atoi(fields[1])
+			return count
+		}
+	}
+	return 0
+}
+
+// Kills the processes left in the cgroup and removes it. The processes which
+// are left after the process group leader finished are the descendants of the process,
+// the cgroup can't be removed until they finish
+func (cg *processCgroup) remove() {
+	var err error
+	for attempt := 0; attempt < cgroupRemoveAttempts; attempt++ {
+		if err = os.Remove(cg.dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		if attempt == 0 {
+			cg.kill()
+		}
+		time.Sleep(cgroupRemoveDelay)
+	}
+	log.Printf("Couldn't remove cgroup '%s'. %s", cg.dir, err.Error())
+}
+
+// Returns the pids of the processes of the cgroup
+func (cg *processCgroup) procs() []int {
+	content, err := ioutil.ReadFile(filepath.Join(cg.dir, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	pids := []int{}
+	for _, field := range strings.Fields(string(content)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// Kills all the processes of the cgroup with SIGKILL, cgroup.kill
+// is used if the kernel supports it, otherwise the processes are killed one by one
+func (cg *processCgroup) kill() {
+	if cg.write("cgroup.kill", "1") == nil {
+		return
+	}
+	for _, pid := range cg.procs() {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+func (cg *processCgroup) write(file string, value string) error {
+	return ioutil.WriteFile(filepath.Join(cg.dir, file), []byte(value), 0644)
+}
+
+// Checks whether limits are valid and can be applied
+func checkLimits(limits *ResourceLimits) error {
+	if limits.Memory < 0 || limits.Cpu < 0 || limits.Pids < 0 {
+		return errors.New("Resource limits must be >= 0")
+	}
+	if limits.Memory > 0 && !cgroups.has("memory") {
+		return errors.New("Memory limit is not supported, it requires cgroup v2 with memory controller")
+	}
+	if limits.Cpu > 0 && !cgroups.has("cpu") {
+		return errors.New("Cpu limit is not supported, it requires cgroup v2 with cpu controller")
+	}
+	if limits.Pids > 0 && !cgroups.has("pids") {
+		return errors.New("Pids limit is not supported, it requires cgroup v2 with pids controller")
+	}
+
+	// Only privileged agent can raise hard limits
+	if os.Geteuid() != 0 {
+		if err := checkHardLimit(syscall.RLIMIT_NOFILE, limits.OpenFiles, "open files"); err != nil {
+			return err
+		}
+		if limits.CoreSize != nil {
+			if err := checkHardLimit(syscall.RLIMIT_CORE, *limits.CoreSize, "core size"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkHardLimit(resource int, value uint64, name string) error {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(resource, &rlimit); err != nil {
+		return nil
+	}
+	if value > rlimit.Max {
+		return errors.New(fmt.Sprintf("The %s limit must be <= %d", name, rlimit.Max))
+	}
+	return nil
+}
+
+// Returns the path of the agent's cgroup relative to the cgroup v2 mount point
+func agentCgroupPath() (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupMountDir, "cgroup.controllers")); err != nil {
+		return "", errors.New("Cgroup v2 is not mounted to " + cgroupMountDir)
+	}
+	content, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", errors.New("The agent doesn't belong to cgroup v2 hierarchy")
+}
+
+func enableController(dir string, controller string) {
+	ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644)
+}
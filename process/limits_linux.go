@@ -0,0 +1,22 @@
+package process
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Configures the command to be started right in the cgroup.
+// The returned file must be closed after the command is started
+func startInCgroup(cmd *exec.Cmd, cg *processCgroup) (*os.File, error) {
+	dir, err := os.Open(cg.dir)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return dir, nil
+}
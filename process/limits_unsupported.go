@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package process
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func startInCgroup(cmd *exec.Cmd, cg *processCgroup) (*os.File, error) {
+	return nil, errors.New("Cgroups are not supported on this platform")
+}
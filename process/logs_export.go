@@ -0,0 +1,335 @@
+package process
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The formats which the logs are exported in
+const (
+	// The json array of the log messages
+	JsonLogsFormat = "json"
+
+	// The json log messages, one message per line
+	NdjsonLogsFormat = "ndjson"
+
+	// The table of the sequence number, time, kind and text of the lines
+	CsvLogsFormat = "csv"
+
+	// The output lines as is, stdout and stderr lines are interleaved
+	RawLogsFormat = "raw"
+
+	// The output lines prefixed with their kind and time
+	TextLogsFormat = "text"
+)
+
+// The formats of the logs archive
+const (
+	TarGzArchiveFormat = "tar.gz"
+	ZipArchiveFormat   = "zip"
+
+	// The name of the archive entry which describes the archived processes
+	manifestName = "manifest.json"
+)
+
+// Describes the content of the logs archive
+type ArchiveManifest struct {
+	// When the archive was created
+	Created time.Time `json:"created"`
+
+	// The format of the archived logs
+	Format string `json:"format"`
+
+	Processes []*ArchivedProcess `json:"processes"`
+}
+
+// The process which logs are archived
+type ArchivedProcess struct {
+	*MachineProcess
+
+	// The name of the archive entry which contains the process logs
+	File string `json:"file"`
+
+	// The number of the archived log lines
+	Lines int `json:"lines"`
+}
+
+// Writes the log messages in one of the export formats
+type logsWriter struct {
+	w      io.Writer
+	format string
+	csv    *csv.Writer
+	count  int
+}
+
+func newLogsWriter(w io.Writer, format string) (*logsWriter, error) {
+	if err := checkLogsFormat(format); err != nil {
+		return nil, err
+	}
+	lw := &logsWriter{w: w, format: format}
+	if format == CsvLogsFormat {
+		lw.csv = csv.NewWriter(w)
+		if err := lw.csv.Write([]string{"seq", "time", "kind", "text"}); err != nil {
+			return nil, err
+		}
+	}
+	return lw, nil
+}
+
+// Checks whether the logs can be exported in the format
+func checkLogsFormat(format string) error {
+	switch format {
+	case JsonLogsFormat, NdjsonLogsFormat, CsvLogsFormat, RawLogsFormat, TextLogsFormat:
+		return nil
+	}
+	return &BadLogsQueryError{fmt.Sprintf("Logs format must be one of '%s', '%s', '%s', '%s', '%s'",
+		JsonLogsFormat, NdjsonLogsFormat, CsvLogsFormat, RawLogsFormat, TextLogsFormat)}
+}
+
+// Returns the content type of the logs exported in the format
+func logsContentType(format string) string {
+	switch format {
+	case JsonLogsFormat:
+		return "application/json"
+	case NdjsonLogsFormat:
+		return "application/x-ndjson"
+	case CsvLogsFormat:
+		return "text/csv; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// Returns the file extension of the logs exported in the format
+func logsFileExtension(format string) string {
+	switch format {
+	case RawLogsFormat, TextLogsFormat:
+		return "log"
+	}
+	return format
+}
+
+func (lw *logsWriter) write(message *LogMessage) error {
+	lw.count++
+	switch lw.format {
+	case JsonLogsFormat, NdjsonLogsFormat:
+		content, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		prefix := ""
+		if lw.format == JsonLogsFormat {
+			prefix = ","
+			if lw.count == 1 {
+				prefix = "["
+			}
+		}
+		_, err = io.WriteString(lw.w, prefix+string(content)+"\n")
+		return err
+	case CsvLogsFormat:
+		return lw.csv.Write([]string{
+			strconv.FormatUint(message.Seq, 10),
+			message.Time.Format(DateTimeFormat),
+			message.Kind,
+			message.Line(),
+		})
+	case RawLogsFormat:
+		_, err := io.WriteString(lw.w, message.Line()+"\n")
+		return err
+	default:
+		_, err := io.WriteString(lw.w, formatTextLog(message))
+		return err
+	}
+}
+
+// Completes the exported logs
+func (lw *logsWriter) close() error {
+	switch lw.format {
+	case JsonLogsFormat:
+		end := "]\n"
+		if lw.count == 0 {
+			end = "[]\n"
+		}
+		_, err := io.WriteString(lw.w, end)
+		return err
+	case CsvLogsFormat:
+		lw.csv.Flush()
+		return lw.csv.Error()
+	}
+	return nil
+}
+
+// Writes the logs of the process which appeared between [from, till], are of the kinds
+// included into the mask and have sequence numbers greater than afterSeq in the given format.
+// Unlike ReadLastLogs the logs are not limited and not kept in memory.
+// Returns the number of the written lines
+func (mp *MachineProcess) ExportLogs(w io.Writer, format string, from time.Time, till time.Time, afterSeq uint64, mask uint64) (int, error) {
+	lw, err := newLogsWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	var writeErr error
+	err = mp.logsSource().ReadForward(from, afterSeq, func(message *LogMessage) bool {
+		if message.Time.After(till) {
+			return false
+		}
+		if isOfKinds(message, mask) {
+			writeErr = lw.write(message)
+		}
+		return writeErr == nil
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = lw.close()
+	}
+	return lw.count, err
+}
+
+// Writes the archive of the logs of the processes in the given format, each process
+// logs are written to the separate entry of the archive, e.g. 'pid-3.ndjson',
+// and the archive is completed with the manifest which describes the archived processes.
+// The processes which logs don't exist are not archived
+func WriteLogsArchive(w io.Writer, archiveFormat string, format string, processes []*MachineProcess, from time.Time, till time.Time, mask uint64) error {
+	if err := checkLogsFormat(format); err != nil {
+		return err
+	}
+	var archive archiveWriter
+	switch archiveFormat {
+	case TarGzArchiveFormat:
+		archive = newTarGzWriter(w)
+	case ZipArchiveFormat:
+		archive = &zipWriter{zip.NewWriter(w)}
+	default:
+		return &BadLogsQueryError{fmt.Sprintf("Archive format must be either '%s' or '%s'", TarGzArchiveFormat, ZipArchiveFormat)}
+	}
+
+	manifest := &ArchiveManifest{
+		Created:   time.Now(),
+		Format:    format,
+		Processes: []*ArchivedProcess{},
+	}
+	for _, p := range processes {
+		archived := &ArchivedProcess{
+			MachineProcess: p,
+			File:           fmt.Sprintf("pid-%d.%s", p.Pid, logsFileExtension(format)),
+		}
+		lines, err := archiveLogs(archive, archived.File, func(w io.Writer) (int, error) {
+			return p.ExportLogs(w, format, from, till, 0, mask)
+		})
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		archived.Lines = lines
+		manifest.Processes = append(manifest.Processes, archived)
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := archive.add(manifestName, int64(len(content)), manifest.Created, bytes.NewReader(content)); err != nil {
+		return err
+	}
+	return archive.close()
+}
+
+// Exports the logs to the temporary file, as the size of the archive entry
+// must be known before its content is written, and adds the file to the archive
+func archiveLogs(archive archiveWriter, name string, export func(w io.Writer) (int, error)) (int, error) {
+	file, err := ioutil.TempFile("", "logs-archive-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	buffered := bufio.NewWriter(file)
+	lines, err := export(buffered)
+	if err != nil {
+		return 0, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return 0, err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return lines, archive.add(name, size, time.Now(), file)
+}
+
+// Writes the entries of the archive
+type archiveWriter interface {
+	add(name string, size int64, modified time.Time, content io.Reader) error
+	close() error
+}
+
+type tarGzWriter struct {
+	gzip *gzip.Writer
+	tar  *tar.Writer
+}
+
+func newTarGzWriter(w io.Writer) *tarGzWriter {
+	gz := gzip.NewWriter(w)
+	return &tarGzWriter{gz, tar.NewWriter(gz)}
+}
+
+func (tw *tarGzWriter) add(name string, size int64, modified time.Time, content io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modified,
+	}
+	if err := tw.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw.tar, content, size)
+	return err
+}
+
+func (tw *tarGzWriter) close() error {
+	if err := tw.tar.Close(); err != nil {
+		return err
+	}
+	return tw.gzip.Close()
+}
+
+type zipWriter struct {
+	zip *zip.Writer
+}
+
+func (zw *zipWriter) add(name string, size int64, modified time.Time, content io.Reader) error {
+	entry, err := zw.zip.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(entry, content, size)
+	return err
+}
+
+func (zw *zipWriter) close() error {
+	return zw.zip.Close()
+}
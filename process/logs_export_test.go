@@ -0,0 +1,133 @@
+package process_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/evoevodin/machine-agent/process"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestLogsAreDownloadedInRequestedFormat(t *testing.T) {
+	p := startAndWaitProcess(t, "printf 'hello, world\\nbye\\n'")
+	defer os.RemoveAll(process.LogsDir)
+
+	server := httptest.NewServer(newProcessRouter())
+	defer server.Close()
+
+	resp, content := getContent(t, fmt.Sprintf("%s/process/%d/logs?format=csv&download=true", server.URL, p.Pid))
+	expectedDisposition := fmt.Sprintf("attachment; filename=pid-%d.csv", p.Pid)
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != expectedDisposition {
+		t.Fatalf("Expected disposition '%s', but got '%s'", expectedDisposition, disposition)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n"))
+	if len(lines) != 3 || string(lines[0]) != "seq,time,kind,text" || !bytes.HasSuffix(lines[1], []byte(",STDOUT,\"hello, world\"")) {
+		t.Fatalf("Expected csv header and 2 lines, but got %q", content)
+	}
+
+	_, content = getContent(t, fmt.Sprintf("%s/process/%d/logs?format=raw", server.URL, p.Pid))
+	if string(content) != "hello, world\nbye\n" {
+		t.Fatalf("Expected raw output lines, but got %q", content)
+	}
+}
+
+func TestLogsOfProcessesAreArchived(t *testing.T) {
+	first := startAndWaitProcess(t, "echo first")
+	second := startAndWaitProcess(t, "echo second; echo third")
+	defer os.RemoveAll(process.LogsDir)
+
+	server := httptest.NewServer(newProcessRouter())
+	defer server.Close()
+
+	// tar.gz
+	_, content := getContent(t, fmt.Sprintf("%s/process/logs/archive?pids=%d,%d", server.URL, first.Pid, second.Pid))
+	gz, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string][]byte{}
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[header.Name], _ = ioutil.ReadAll(reader)
+	}
+	checkArchiveEntries(t, entries, first, second)
+
+	// zip
+	_, content = getContent(t, fmt.Sprintf("%s/process/logs/archive?pids=%d,%d&archive=zip", server.URL, first.Pid, second.Pid))
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = map[string][]byte{}
+	for _, file := range archive.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[file.Name], _ = ioutil.ReadAll(f)
+		f.Close()
+	}
+	checkArchiveEntries(t, entries, first, second)
+}
+
+func checkArchiveEntries(t *testing.T, entries map[string][]byte, first *process.MachineProcess, second *process.MachineProcess) {
+	manifest := &struct {
+		Format    string `json:"format"`
+		Processes []struct {
+			Pid   uint64 `json:"pid"`
+			File  string `json:"file"`
+			Lines int    `json:"lines"`
+		} `json:"processes"`
+	}{}
+	if err := json.Unmarshal(entries["manifest.json"], manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Format != process.NdjsonLogsFormat || len(manifest.Processes) != 2 {
+		t.Fatalf("Expected manifest of 2 processes in ndjson format, but got %+v", manifest)
+	}
+	for i, p := range []*process.MachineProcess{first, second} {
+		archived := manifest.Processes[i]
+		if archived.Pid != p.Pid || archived.Lines != i+1 {
+			t.Fatalf("Expected process '%d' with %d lines in manifest, but got %+v", p.Pid, i+1, archived)
+		}
+		lines := bytes.Split(bytes.TrimSuffix(entries[archived.File], []byte("\n")), []byte("\n"))
+		if len(lines) != i+1 {
+			t.Fatalf("Expected %d lines in '%s', but got %q", i+1, archived.File, entries[archived.File])
+		}
+		message := &process.LogMessage{}
+		if err := json.Unmarshal(lines[0], message); err != nil || message.Seq != 1 {
+			t.Fatalf("Expected the first line of '%s' to be json log message, but got '%s'", archived.File, lines[0])
+		}
+	}
+}
+
+func getContent(t *testing.T, url string) (*http.Response, []byte) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", resp.StatusCode)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, content
+}
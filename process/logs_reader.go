@@ -1,13 +1,10 @@
 package process
 
 import (
-	"bufio"
-	"encoding/json"
-	"io"
-	"os"
 	"time"
 )
 
+// Reads the logs written by the FileLogger, see LogsStore
 type LogsReader struct {
 	filename string
 	readFrom *time.Time
@@ -36,13 +33,6 @@ func (lr *LogsReader) Till(time time.Time) *LogsReader {
 // decoding of file content failed.
 // If no logs matched time frame, an empty slice will be returned.
 func (lr *LogsReader) ReadLogs() ([]*LogMessage, error) {
-	// Open logs file for reading logs
-	logsFile, err := os.Open(lr.filename)
-	if err != nil {
-		return nil, err
-	}
-	defer logsFile.Close()
-
 	from := time.Time{}
 	if lr.readFrom != nil {
 		from = *lr.readFrom
@@ -51,26 +41,61 @@ func (lr *LogsReader) ReadLogs() ([]*LogMessage, error) {
 	if lr.readTill != nil {
 		till = *lr.readTill
 	}
+	return readLogsRange(lr, from, till)
+}
+
+func (lr *LogsReader) ReadForward(from time.Time, afterSeq uint64, handle func(message *LogMessage) bool) error {
+	segments, err := openSegments(lr.filename)
+	if err != nil {
+		return err
+	}
+	defer closeSegments(segments)
+	return readForward(segments, from, afterSeq, handle)
+}
 
-	// Read logs
+func (lr *LogsReader) ReadBackward(till time.Time, handle func(message *LogMessage) bool) error {
+	segments, err := openSegments(lr.filename)
+	if err != nil {
+		return err
+	}
+	defer closeSegments(segments)
+	return readBackward(segments, till, handle)
+}
+
+// Reads the logs between [from, till] inclusive
+func readLogsRange(source LogsSource, from time.Time, till time.Time) ([]*LogMessage, error) {
 	logs := []*LogMessage{}
-	decoder := json.NewDecoder(bufio.NewReader(logsFile))
-	for {
-		message := &LogMessage{}
-		err = decoder.Decode(message)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
+	err := source.ReadForward(from, 0, func(message *LogMessage) bool {
+		if message.Time.After(till) {
+			return false
 		}
-		if message.Time.Before(from) {
-			continue
+		logs = append(logs, message)
+		return true
+	})
+	return logs, err
+}
+
+// Reads at most limit latest logs of the kinds included into the mask, which appeared
+// between [from, till] and have sequence numbers greater than afterSeq, the skip latest
+// of such logs are skipped. The logs are returned from the earliest to the latest
+func readLastLogs(source LogsSource, from time.Time, till time.Time, afterSeq uint64, mask uint64, limit int, skip int) ([]*LogMessage, error) {
+	logs := []*LogMessage{}
+	err := source.ReadBackward(till, func(message *LogMessage) bool {
+		if message.Time.Before(from) || (afterSeq != 0 && message.Seq <= afterSeq) {
+			return false
 		}
-		if message.Time.After(till) {
-			break
+		if !isOfKinds(message, mask) {
+			return true
+		}
+		if skip > 0 {
+			skip--
+			return true
 		}
 		logs = append(logs, message)
+		return len(logs) < limit
+	})
+	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+		logs[i], logs[j] = logs[j], logs[i]
 	}
-	return logs, nil
+	return logs, err
 }
@@ -1,8 +1,10 @@
 package process_test
 
 import (
+	"fmt"
 	"github.com/evoevodin/machine-agent/process"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -42,8 +44,261 @@ func TestReadLogs(t *testing.T) {
 		{Kind: process.StderrKind, Time: now.Add(time.Second * 4), Text: "line4"},
 	}
 	for i := 0; i < len(logs); i++ {
-		if *logs[i] != expected[i] {
+		if !equalMessages(*logs[i], expected[i]) {
 			t.Fatalf("Expected: '%v' Found '%v'", expected[i], *logs[i])
 		}
 	}
 }
+
+func TestReadLogsAcrossSegments(t *testing.T) {
+	filename := os.TempDir() + string(os.PathSeparator) + randomName(10)
+	defer os.Remove(filename)
+
+	segmentSize := process.LogsSegmentSize
+	process.LogsSegmentSize = 100 * 1024
+	defer func() { process.LogsSegmentSize = segmentSize }()
+
+	fl, err := process.NewLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 1; i <= 5000; i++ {
+		fl.Append(&process.LogMessage{
+			Kind: process.StdoutKind,
+			Time: now.Add(time.Duration(i) * time.Millisecond),
+			Text: fmt.Sprintf("line%d", i),
+			Seq:  uint64(i),
+		})
+	}
+	fl.Close()
+	defer func() {
+		segments, _ := filepath.Glob(filename + ".*")
+		for _, segment := range segments {
+			os.Remove(segment)
+		}
+	}()
+	// Completed segments are compressed by default
+	if segments, _ := filepath.Glob(filename + ".[0-9].gz"); len(segments) < 2 {
+		t.Fatalf("Expected logs to be split into compressed segments, but got %d compressed segments", len(segments))
+	}
+
+	reader := process.NewLogsReader(filename)
+	logs, err := reader.Till(now.Add(time.Hour)).ReadLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 5000 || logs[0].Seq != 1 || logs[4999].Seq != 5000 {
+		t.Fatalf("Expected to read all the 5000 lines in order, but got %d lines", len(logs))
+	}
+
+	// Forward from the sequence number
+	seqs := []uint64{}
+	reader.ReadForward(time.Time{}, 4990, func(message *process.LogMessage) bool {
+		seqs = append(seqs, message.Seq)
+		return true
+	})
+	if len(seqs) != 10 || seqs[0] != 4991 {
+		t.Fatalf("Expected to read 10 lines after line 4990, but got %v", seqs)
+	}
+
+	// Backward from the time
+	seqs = seqs[:0]
+	reader.ReadBackward(now.Add(2500*time.Millisecond), func(message *process.LogMessage) bool {
+		seqs = append(seqs, message.Seq)
+		return len(seqs) < 3
+	})
+	if len(seqs) != 3 || seqs[0] != 2500 || seqs[2] != 2498 {
+		t.Fatalf("Expected to read lines 2500, 2499, 2498 backward, but got %v", seqs)
+	}
+}
+
+func TestOldestLogsSegmentsAreDroppedAtMaxSize(t *testing.T) {
+	filename := os.TempDir() + string(os.PathSeparator) + randomName(10)
+	defer removeLogFiles(filename)
+
+	compress := false
+	fl, err := process.NewLimitedLogger(filename, &process.LogsLimits{
+		MaxSize:  256 * 1024,
+		Policy:   process.DropOldestLogsPolicy,
+		Compress: &compress,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	writeLogLines(fl, now, 10000)
+	fl.Close()
+
+	if size := logFilesSize(filename); size > 256*1024 {
+		t.Fatalf("Expected logs size to be <= %d, but it is %d", 256*1024, size)
+	}
+	logs, err := process.NewLogsReader(filename).Till(now.Add(time.Hour)).ReadLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) == 0 || logs[len(logs)-1].Seq != 10000 || logs[0].Seq == 1 {
+		t.Fatalf("Expected the latest lines to be kept, but got %d lines", len(logs))
+	}
+	for i := 1; i < len(logs); i++ {
+		if logs[i].Seq != logs[i-1].Seq+1 {
+			t.Fatalf("Expected the kept lines to be continuous, but line %d follows line %d", logs[i].Seq, logs[i-1].Seq)
+		}
+	}
+}
+
+func TestLogsAreNotRecordedAfterMaxSize(t *testing.T) {
+	filename := os.TempDir() + string(os.PathSeparator) + randomName(10)
+	defer removeLogFiles(filename)
+
+	compress := false
+	fl, err := process.NewLimitedLogger(filename, &process.LogsLimits{
+		MaxSize:  256 * 1024,
+		Policy:   process.StopLogsPolicy,
+		Compress: &compress,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	writeLogLines(fl, now, 10000)
+	fl.Close()
+
+	if size := logFilesSize(filename); size > 256*1024 {
+		t.Fatalf("Expected logs size to be <= %d, but it is %d", 256*1024, size)
+	}
+	logs, err := process.NewLogsReader(filename).Till(now.Add(time.Hour)).ReadLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) == 0 || logs[0].Seq != 1 || logs[len(logs)-1].Seq == 10000 {
+		t.Fatalf("Expected the earliest lines to be kept, but got %d lines", len(logs))
+	}
+	if int(logs[len(logs)-1].Seq) != len(logs) {
+		t.Fatalf("Expected the kept lines to be continuous, but got %d lines till line %d", len(logs), logs[len(logs)-1].Seq)
+	}
+}
+
+func TestLogsNotRecordedAfterMaxSizeAreNotBuffered(t *testing.T) {
+	filename := os.TempDir() + string(os.PathSeparator) + randomName(10)
+	defer removeLogFiles(filename)
+
+	compress := false
+	fl, err := process.NewLimitedLogger(filename, &process.LogsLimits{
+		MaxSize:  256 * 1024,
+		Policy:   process.StopLogsPolicy,
+		Compress: &compress,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := process.NewBufferedLogs(fl, 1024*1024)
+	now := time.Now()
+	for i := 1; i <= 10000; i++ {
+		logs.Append(&process.LogMessage{
+			Kind: process.StdoutKind,
+			Time: now.Add(time.Duration(i) * time.Millisecond),
+			Text: fmt.Sprintf("line%d", i),
+			Seq:  uint64(i),
+		})
+	}
+	logs.Close()
+
+	var last *process.LogMessage
+	logs.ReadBackward(now.Add(time.Hour), func(message *process.LogMessage) bool {
+		last = message
+		return false
+	})
+	recorded, err := process.NewLogsReader(filename).Till(now.Add(time.Hour)).ReadLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last == nil || len(recorded) == 0 || last.Seq != recorded[len(recorded)-1].Seq {
+		t.Fatalf("Expected the latest buffered line to be the latest recorded one, but got %v", last)
+	}
+}
+
+func writeLogLines(fl *process.FileLogger, start time.Time, count int) {
+	for i := 1; i <= count; i++ {
+		fl.Append(&process.LogMessage{
+			Kind: process.StdoutKind,
+			Time: start.Add(time.Duration(i) * time.Millisecond),
+			Text: fmt.Sprintf("line%d", i),
+			Seq:  uint64(i),
+		})
+	}
+}
+
+// Returns the size of the logs segments, not including their indexes
+func logFilesSize(filename string) int64 {
+	names, _ := filepath.Glob(filename + ".*")
+	size := int64(0)
+	for _, name := range append(names, filename) {
+		if filepath.Ext(name) == ".idx" {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func removeLogFiles(filename string) {
+	names, _ := filepath.Glob(filename + ".*")
+	for _, name := range append(names, filename) {
+		os.Remove(name)
+	}
+}
+
+func TestRecentLogsAreReadFromMemory(t *testing.T) {
+	filename := os.TempDir() + string(os.PathSeparator) + randomName(10)
+	defer removeLogFiles(filename)
+
+	fl, err := process.NewLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The buffer keeps about 10 messages
+	logs := process.NewBufferedLogs(fl, 10*(64+8))
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		logs.Append(&process.LogMessage{
+			Kind: process.StdoutKind,
+			Time: now.Add(time.Duration(i) * time.Millisecond),
+			Text: fmt.Sprintf("line%03d", i),
+			Seq:  uint64(i),
+		})
+	}
+	logs.Flush()
+
+	// The earlier logs are read from the file
+	seqs := []uint64{}
+	logs.ReadBackward(now.Add(time.Hour), func(message *process.LogMessage) bool {
+		seqs = append(seqs, message.Seq)
+		return len(seqs) < 20
+	})
+	for i, seq := range seqs {
+		if seq != uint64(100-i) {
+			t.Fatalf("Expected to read lines from 100 to 81 backward, but got %v", seqs)
+		}
+	}
+	if len(seqs) != 20 {
+		t.Fatalf("Expected to read 20 lines backward, but got %v", seqs)
+	}
+
+	// The recent logs are still available when the file is gone
+	os.Remove(filename)
+	seqs = seqs[:0]
+	err = logs.ReadForward(time.Time{}, 95, func(message *process.LogMessage) bool {
+		seqs = append(seqs, message.Seq)
+		return true
+	})
+	if err != nil || len(seqs) != 5 || seqs[0] != 96 {
+		t.Fatalf("Expected to read 5 lines after line 95 from memory, but got %v, %v", seqs, err)
+	}
+	if err := logs.ReadForward(time.Time{}, 50, func(message *process.LogMessage) bool { return true }); !os.IsNotExist(err) {
+		t.Fatalf("Expected the lines after line 50 to be read from the file, but got %v", err)
+	}
+}
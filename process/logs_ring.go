@@ -0,0 +1,139 @@
+package process
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+// The approximate memory taken by the buffered message besides its text
+const ringMessageOverhead = 64
+
+// The size of the recent logs of each process kept in memory(in bytes), 0 disables the buffer
+var LogsBufferSize int64
+
+func init() {
+	flag.Int64Var(&LogsBufferSize, "logs-buffer-size", 1024*1024,
+		`The size of the most recent logs of each process kept in memory(in bytes),
+		the recent logs and subscription replays are read from memory instead of the logs file.
+		0 disables the buffer`)
+}
+
+// Keeps the most recent log messages in memory, the oldest messages
+// are evicted when the size of the buffered messages exceeds the maximum size
+type LogsRing struct {
+	mutex    sync.RWMutex
+	messages []*LogMessage
+	size     int64
+	maxSize  int64
+}
+
+func NewLogsRing(maxSize int64) *LogsRing {
+	return &LogsRing{maxSize: maxSize}
+}
+
+func (ring *LogsRing) Append(message *LogMessage) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	ring.messages = append(ring.messages, message)
+	ring.size += messageSize(message)
+	evicted := 0
+	for ring.size > ring.maxSize && evicted < len(ring.messages)-1 {
+		ring.size -= messageSize(ring.messages[evicted])
+		evicted++
+	}
+	if evicted != 0 {
+		// Copying keeps the underlying array from growing infinitely
+		ring.messages = append([]*LogMessage{}, ring.messages[evicted:]...)
+	}
+}
+
+// Returns the buffered messages from the earliest to the latest
+func (ring *LogsRing) snapshot() []*LogMessage {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	return ring.messages[:len(ring.messages):len(ring.messages)]
+}
+
+func messageSize(message *LogMessage) int64 {
+	return int64(len(message.Text)) + ringMessageOverhead
+}
+
+// Stores the logs and keeps the most recent of them in the ring,
+// the logs are read from the ring while it contains them and then from the store
+type bufferedLogs struct {
+	LogsStore
+	ring *LogsRing
+}
+
+// Returns the store which keeps the most recent logs
+// of the given store in memory, the store is returned as is if the size is not positive
+func NewBufferedLogs(store LogsStore, size int64) LogsStore {
+	if size <= 0 {
+		return store
+	}
+	return &bufferedLogs{store, NewLogsRing(size)}
+}
+
+// Buffers only the messages recorded by the store, so the ring never serves the logs which are not on disk
+func (bl *bufferedLogs) Append(message *LogMessage) bool {
+	if !bl.LogsStore.Append(message) {
+		return false
+	}
+	bl.ring.Append(message)
+	return true
+}
+
+// Returns the store without the buffer
+func unbuffered(store LogsStore) LogsStore {
+	if bl, ok := store.(*bufferedLogs); ok {
+		return bl.LogsStore
+	}
+	return store
+}
+
+func (bl *bufferedLogs) ReadForward(from time.Time, afterSeq uint64, handle func(message *LogMessage) bool) error {
+	messages := bl.ring.snapshot()
+
+	// The ring contains all the requested logs if the logs preceding it don't fit,
+	// as the times never decrease the earlier logs are before the first buffered one
+	if len(messages) == 0 || !(messages[0].Seq == 1 || afterSeq+1 >= messages[0].Seq || from.After(messages[0].Time)) {
+		return bl.LogsStore.ReadForward(from, afterSeq, handle)
+	}
+	for _, message := range messages {
+		if message.Time.Before(from) || (afterSeq != 0 && message.Seq <= afterSeq) {
+			continue
+		}
+		if !handle(message) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (bl *bufferedLogs) ReadBackward(till time.Time, handle func(message *LogMessage) bool) error {
+	messages := bl.ring.snapshot()
+	if len(messages) == 0 {
+		return bl.LogsStore.ReadBackward(till, handle)
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Time.After(till) {
+			continue
+		}
+		if !handle(messages[i]) {
+			return nil
+		}
+	}
+
+	// The earlier logs are read from the store
+	first := messages[0]
+	if first.Seq == 1 {
+		return nil
+	}
+	if first.Time.Before(till) {
+		till = first.Time
+	}
+	return bl.LogsStore.ReadBackward(till, func(message *LogMessage) bool {
+		return message.Seq >= first.Seq || handle(message)
+	})
+}
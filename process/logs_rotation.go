@@ -0,0 +1,221 @@
+package process
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// The oldest completed segments are removed to keep the logs under the maximum size
+	DropOldestLogsPolicy = "drop_oldest"
+
+	// The logs are not recorded any more once the maximum size is reached
+	StopLogsPolicy = "stop"
+
+	// The segment size is never greater than this part of the maximum logs size,
+	// so dropping the oldest segment doesn't remove most of the logs at once
+	maxSizeSegments = 4
+
+	// The minimum size of the logs segment, the smaller segment
+	// would be completed and compressed more often than it is indexed
+	minLogsSegmentSize = indexInterval
+
+	// The suffix of the file which is being compressed
+	tmpSuffix = ".tmp"
+)
+
+var (
+	// The maximum size of the logs of each process(in bytes), 0 means no limit
+	LogsMaxSize int64
+
+	// What happens when the process logs reach the maximum size
+	LogsMaxSizePolicy string
+
+	// Whether completed logs segments are compressed
+	LogsCompress bool
+)
+
+// Defines how much of the process logs is kept on disk.
+// Zero values mean that the agent defaults are used
+type LogsLimits struct {
+	// The maximum size of all the process logs segments(in bytes), the size
+	// of compressed segments is the size on disk. 0 means the agent's maximum size
+	MaxSize int64 `json:"maxSize"`
+
+	// The size of the logs segment(in bytes), 0 means the agent's segment size.
+	// If the maximum size is set the segment is never greater than its quarter,
+	// the segment is never smaller than 64KB
+	SegmentSize int64 `json:"segmentSize"`
+
+	// Either 'drop_oldest' to remove the oldest segments when the maximum size is reached
+	// or 'stop' to stop recording the logs, empty value means the agent's policy
+	Policy string `json:"policy"`
+
+	// Whether completed segments are compressed, nil means the agent's default
+	Compress *bool `json:"compress"`
+}
+
+func init() {
+	flag.Int64Var(&LogsMaxSize, "logs-max-size", 0,
+		`The maximum size of the logs of each process(in bytes), 0 means no limit,
+		otherwise it must be at least 262144. The process may override it`)
+	flag.StringVar(&LogsMaxSizePolicy, "logs-max-size-policy", DropOldestLogsPolicy,
+		`What happens when the process logs reach the maximum size, either 'drop_oldest'
+		to remove the oldest logs segments or 'stop' to stop recording the logs`)
+	flag.BoolVar(&LogsCompress, "logs-compress", true, "Whether completed process logs segments are gzip compressed")
+}
+
+// Checks whether logs limits are valid
+func checkLogsLimits(limits *LogsLimits) error {
+	if limits.MaxSize < 0 || limits.SegmentSize < 0 {
+		return errors.New("Logs 'maxSize' and 'segmentSize' must be >= 0")
+	}
+	if limits.SegmentSize != 0 && limits.SegmentSize < minLogsSegmentSize {
+		return errors.New(fmt.Sprintf("Logs 'segmentSize' must be >= %d", minLogsSegmentSize))
+	}
+	if limits.MaxSize != 0 && limits.MaxSize < maxSizeSegments*minLogsSegmentSize {
+		return errors.New(fmt.Sprintf("Logs 'maxSize' must be >= %d", maxSizeSegments*minLogsSegmentSize))
+	}
+	switch limits.Policy {
+	case "", DropOldestLogsPolicy, StopLogsPolicy:
+	default:
+		return errors.New(fmt.Sprintf("Logs policy must be either '%s' or '%s'", DropOldestLogsPolicy, StopLogsPolicy))
+	}
+	return nil
+}
+
+// Checks whether the agent's logs limits set with the flags are valid
+func CheckLogsFlags() error {
+	if LogsMaxSizePolicy == "" {
+		return errors.New(fmt.Sprintf("Logs policy must be either '%s' or '%s'", DropOldestLogsPolicy, StopLogsPolicy))
+	}
+	return checkLogsLimits(&LogsLimits{
+		MaxSize:     LogsMaxSize,
+		SegmentSize: LogsSegmentSize,
+		Policy:      LogsMaxSizePolicy,
+	})
+}
+
+// Returns the limits which the logs are written with,
+// the agent defaults are applied to the not specified limits
+func effectiveLogsLimits(limits *LogsLimits) *LogsLimits {
+	effective := &LogsLimits{
+		MaxSize:     LogsMaxSize,
+		SegmentSize: LogsSegmentSize,
+		Policy:      LogsMaxSizePolicy,
+		Compress:    &LogsCompress,
+	}
+	if limits != nil {
+		if limits.MaxSize != 0 {
+			effective.MaxSize = limits.MaxSize
+		}
+		if limits.SegmentSize != 0 {
+			effective.SegmentSize = limits.SegmentSize
+		}
+		if limits.Policy != "" {
+			effective.Policy = limits.Policy
+		}
+		if limits.Compress != nil {
+			effective.Compress = limits.Compress
+		}
+	}
+	if effective.MaxSize > 0 && effective.SegmentSize > effective.MaxSize/maxSizeSegments {
+		effective.SegmentSize = effective.MaxSize / maxSizeSegments
+	}
+	if effective.SegmentSize < minLogsSegmentSize {
+		effective.SegmentSize = minLogsSegmentSize
+	}
+	return effective
+}
+
+// Compresses the completed segment into the temporary files
+// which are named as the compressed segment and its index with '.tmp' suffix.
+// Each block between the index entries is compressed as a separate gzip member,
+// so the compressed segment is indexed in the same way as the original one.
+// Returns the size of the compressed segment
+func compressSegment(name string) (int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	index := readIndex(name+indexSuffix, info.Size())
+
+	compressed, err := os.Create(name + compressedSuffix + tmpSuffix)
+	if err != nil {
+		return 0, err
+	}
+	defer compressed.Close()
+
+	compressedIndex := &bytes.Buffer{}
+	offset := int64(0)
+	for i, entry := range index {
+		end := info.Size()
+		if i+1 < len(index) {
+			end = index[i+1].Offset
+		}
+		block := &bytes.Buffer{}
+		writer := gzip.NewWriter(block)
+		if _, err := io.Copy(writer, io.NewSectionReader(file, entry.Offset, end-entry.Offset)); err != nil {
+			return 0, err
+		}
+		if err := writer.Close(); err != nil {
+			return 0, err
+		}
+		compressedIndex.Write(encodeIndexEntry(indexEntry{entry.Seq, entry.Time, offset}))
+		offset += int64(block.Len())
+		if _, err := block.WriteTo(compressed); err != nil {
+			return 0, err
+		}
+	}
+	if err := compressed.Sync(); err != nil {
+		return 0, err
+	}
+	if len(index) == 1 && index[0].Time.IsZero() {
+		// Not indexed segment is read from its beginning
+		compressedIndex.Reset()
+	}
+	f, err := os.Create(name + compressedSuffix + indexSuffix + tmpSuffix)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := compressedIndex.WriteTo(f); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// Replaces the completed segment with its compressed version
+// created by compressSegment, the index is replaced first, so the compressed
+// segment is never read with the index of the original segment
+func replaceWithCompressed(name string) error {
+	if err := os.Rename(name+compressedSuffix+indexSuffix+tmpSuffix, name+compressedSuffix+indexSuffix); err != nil {
+		return err
+	}
+	if err := os.Rename(name+compressedSuffix+tmpSuffix, name+compressedSuffix); err != nil {
+		return err
+	}
+	os.Remove(name)
+	os.Remove(name + indexSuffix)
+	return nil
+}
+
+// Removes the completed segment whether it is compressed or not
+func removeSegment(name string) {
+	for _, suffix := range []string{"", compressedSuffix} {
+		os.Remove(name + suffix)
+		os.Remove(name + suffix + indexSuffix)
+		os.Remove(name + suffix + tmpSuffix)
+		os.Remove(name + suffix + indexSuffix + tmpSuffix)
+	}
+}
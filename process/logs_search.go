@@ -0,0 +1,169 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The maximum number of the context lines around the match
+const MaxSearchContext = 100
+
+// Returned when the logs query is not valid
+type BadLogsQueryError struct {
+	Message string
+}
+
+func (err *BadLogsQueryError) Error() string {
+	return err.Message
+}
+
+// Describes which log lines are searched for
+type LogsQuery struct {
+	// The substring or the regular expression which the line must match
+	Text string
+
+	// Whether the text is the regular expression
+	Regexp bool
+
+	// Whether the letter case is ignored
+	IgnoreCase bool
+
+	// The kinds of the lines which are searched, e.g. StdoutBit|StderrBit
+	Mask uint64
+
+	// The time range of the searched lines, inclusive
+	From time.Time
+	Till time.Time
+
+	// How many lines before and after the matched line are returned with it
+	Context int
+
+	// The maximum number of the returned matches, the earliest matches are returned
+	Limit int
+}
+
+// The log line which matches the query
+type LogsMatch struct {
+	Pid uint64 `json:"pid"`
+	*LogMessage
+
+	// The lines preceding the matched line, present only if the context is requested
+	Before []*LogMessage `json:"before,omitempty"`
+
+	// The lines following the matched line, present only if the context is requested
+	After []*LogMessage `json:"after,omitempty"`
+}
+
+// Checks the query and returns the function which matches the lines
+func (query *LogsQuery) matcher() (func(line string) bool, error) {
+	if query.Text == "" {
+		return nil, &BadLogsQueryError{"Search text required"}
+	}
+	if query.Context < 0 || query.Context > MaxSearchContext {
+		return nil, &BadLogsQueryError{fmt.Sprintf("Required 'context' to be in range [0, %d]", MaxSearchContext)}
+	}
+	if query.Limit < 1 {
+		return nil, &BadLogsQueryError{"Required 'limit' to be > 0"}
+	}
+	if query.Regexp {
+		expr := query.Text
+		if query.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, &BadLogsQueryError{"Bad search regexp, " + err.Error()}
+		}
+		return re.MatchString, nil
+	}
+	if query.IgnoreCase {
+		text := strings.ToLower(query.Text)
+		return func(line string) bool {
+			return strings.Contains(strings.ToLower(line), text)
+		}, nil
+	}
+	return func(line string) bool {
+		return strings.Contains(line, query.Text)
+	}, nil
+}
+
+// Searches the logs of the process. Context lines are taken from the logs of all kinds
+func (mp *MachineProcess) SearchLogs(query *LogsQuery) ([]*LogsMatch, error) {
+	match, err := query.matcher()
+	if err != nil {
+		return nil, err
+	}
+	return mp.searchLogs(query, match, query.Limit)
+}
+
+// Searches the logs of all the processes, both alive and dead, which have the given
+// name and type, an empty name or type matches any. Matches are ordered by the process id
+func SearchProcessesLogs(name string, processType string, query *LogsQuery) ([]*LogsMatch, error) {
+	match, err := query.matcher()
+	if err != nil {
+		return nil, err
+	}
+	found := []*MachineProcess{}
+	for _, p := range GetProcesses(true) {
+		if (name == "" || p.Name == name) && (processType == "" || p.Type == processType) {
+			found = append(found, p)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Pid < found[j].Pid })
+
+	matches := []*LogsMatch{}
+	for _, p := range found {
+		if len(matches) == query.Limit {
+			break
+		}
+		processMatches, err := p.searchLogs(query, match, query.Limit-len(matches))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, processMatches...)
+	}
+	return matches, nil
+}
+
+func (mp *MachineProcess) searchLogs(query *LogsQuery, match func(line string) bool, limit int) ([]*LogsMatch, error) {
+	matches := []*LogsMatch{}
+
+	// The latest lines which precede the next match, and the matches which wait for their following lines
+	before := []*LogMessage{}
+	pending := []*LogsMatch{}
+	err := mp.logsSource().ReadForward(query.From, 0, func(message *LogMessage) bool {
+		if message.Time.After(query.Till) {
+			return false
+		}
+		for len(pending) != 0 && len(pending[0].After) == query.Context {
+			pending = pending[1:]
+		}
+		for _, found := range pending {
+			found.After = append(found.After, message)
+		}
+		if len(matches) < limit && isOfKinds(message, query.Mask) && match(message.Line()) {
+			found := &LogsMatch{Pid: mp.Pid, LogMessage: message}
+			if query.Context > 0 {
+				found.Before = append([]*LogMessage{}, before...)
+				found.After = []*LogMessage{}
+				pending = append(pending, found)
+			}
+			matches = append(matches, found)
+		}
+		if query.Context > 0 {
+			before = append(before, message)
+			if len(before) > query.Context {
+				before = before[1:]
+			}
+		}
+		return len(matches) < limit || len(pending) != 0
+	})
+	return matches, err
+}
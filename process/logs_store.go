@@ -0,0 +1,377 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The logs of the process are stored in the segments, each segment is the file of json
+// encoded log messages, one message per line. The latest segment is written to the logs
+// file itself e.g. 'pid-3', when it reaches the segment size it is renamed to the numbered
+// segment e.g. 'pid-3.1', and the next segment is started. Each segment has the sparse index
+// e.g. 'pid-3.idx', 'pid-3.1.idx' which entries point to the segment lines periodically,
+// so the logs can be read from the given time or sequence number and backward from the latest ones
+// without reading the whole segments. Completed segments may be compressed e.g. 'pid-3.1.gz'
+// with the index 'pid-3.1.gz.idx', see compressSegment.
+const (
+	indexSuffix      = ".idx"
+	compressedSuffix = ".gz"
+
+	// How many bytes of the segment are between the index entries
+	indexInterval = 64 * 1024
+
+	// The size of the index entry, the entry consists of
+	// the sequence number, the time in nanoseconds and the offset
+	indexEntrySize = 24
+)
+
+// The size of the segment which the logs are written to,
+// when it is reached the next segment is started
+var LogsSegmentSize int64
+
+// Reads the stored logs
+type LogsSource interface {
+
+	// Calls handle for the logs which appeared at or after the given time and
+	// have sequence numbers greater than afterSeq, from the earliest to the latest,
+	// while handle returns true. Zero afterSeq means that any sequence number fits
+	ReadForward(from time.Time, afterSeq uint64, handle func(message *LogMessage) bool) error
+
+	// Calls handle for the logs which appeared at or before the given time,
+	// from the latest to the earliest, while handle returns true
+	ReadBackward(till time.Time, handle func(message *LogMessage) bool) error
+}
+
+// Stores the logs and reads them back
+type LogsStore interface {
+	LogsSource
+
+	// Appends the message to the logs. Messages must be appended in the order
+	// of their sequence numbers and the time of the message must not be before
+	// the time of the previous message. Returns false if the message is not recorded
+	// e.g. the logs reached their maximum size
+	Append(message *LogMessage) bool
+
+	// Writes all the appended messages, so they can be read
+	Flush()
+
+	// Flushes the logs, no messages are appended after the store is closed
+	Close()
+}
+
+// Points to the line of the segment
+type indexEntry struct {
+	Seq    uint64
+	Time   time.Time
+	Offset int64
+}
+
+// The segment opened for reading
+type logSegment struct {
+	file  *os.File
+	size  int64
+	index []indexEntry
+
+	// Whether the segment is compressed, the blocks between
+	// the index entries of such segment are compressed separately
+	compressed bool
+}
+
+// The index entry of the opened segments
+type segmentEntry struct {
+	segment int
+	entry   int
+}
+
+func init() {
+	flag.Int64Var(&LogsSegmentSize, "logs-segment-size", 64*1024*1024,
+		`The size of the process logs segment(in bytes), when the segment reaches
+		this size the logs are continued in the next one. The segment is never smaller than 64KB`)
+}
+
+func encodeIndexEntry(entry indexEntry) []byte {
+	data := make([]byte, indexEntrySize)
+	binary.LittleEndian.PutUint64(data[0:], entry.Seq)
+	binary.LittleEndian.PutUint64(data[8:], uint64(entry.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(data[16:], uint64(entry.Offset))
+	return data
+}
+
+// Reads the index of the segment, the segment which doesn't have the index
+// e.g. written by the previous agent versions is indexed by its beginning only.
+// The empty segment has no entries
+func readIndex(filename string, size int64) []indexEntry {
+	if size == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil || len(data) < indexEntrySize {
+		return []indexEntry{{}}
+	}
+	index := make([]indexEntry, 0, len(data)/indexEntrySize)
+	for i := 0; i+indexEntrySize <= len(data); i += indexEntrySize {
+		entry := indexEntry{
+			Seq:    binary.LittleEndian.Uint64(data[i:]),
+			Time:   time.Unix(0, int64(binary.LittleEndian.Uint64(data[i+8:]))),
+			Offset: int64(binary.LittleEndian.Uint64(data[i+16:])),
+		}
+		// The entries are written after the lines they point to
+		if entry.Offset >= size {
+			break
+		}
+		index = append(index, entry)
+	}
+	if len(index) == 0 || index[0].Offset != 0 {
+		return []indexEntry{{}}
+	}
+	return index
+}
+
+// Returns the numbers of the completed logs segments from the earliest to the latest
+func segmentNumbers(filename string) ([]int, error) {
+	names, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+	found := map[int]bool{}
+	numbers := []int{}
+	for _, name := range names {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(name, filename+"."), compressedSuffix)
+		if number, err := strconv.Atoi(suffix); err == nil && !found[number] {
+			found[number] = true
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+func segmentName(filename string, number int) string {
+	return filename + "." + strconv.Itoa(number)
+}
+
+// Opens all the logs segments, the latest segment which
+// is the logs file itself must exist
+func openSegments(filename string) ([]*logSegment, error) {
+	numbers, err := segmentNumbers(filename)
+	if err != nil {
+		return nil, err
+	}
+	segments := []*logSegment{}
+	for _, number := range numbers {
+		// The segment is either not compressed yet, or compressed,
+		// or dropped after it was listed
+		segment, err := openSegment(segmentName(filename, number), false)
+		if os.IsNotExist(err) {
+			segment, err = openSegment(segmentName(filename, number)+compressedSuffix, true)
+		}
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			closeSegments(segments)
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	segment, err := openSegment(filename, false)
+	if err != nil {
+		closeSegments(segments)
+		return nil, err
+	}
+	return append(segments, segment), nil
+}
+
+func openSegment(name string, compressed bool) (*logSegment, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &logSegment{
+		file:       file,
+		size:       info.Size(),
+		compressed: compressed,
+		index:      readIndex(name+indexSuffix, info.Size()),
+	}, nil
+}
+
+func closeSegments(segments []*logSegment) {
+	for _, segment := range segments {
+		segment.file.Close()
+	}
+}
+
+// Returns the reader of the segment lines starting from the offset
+func (segment *logSegment) readFrom(offset int64) (io.Reader, error) {
+	section := io.NewSectionReader(segment.file, offset, segment.size-offset)
+	if segment.compressed {
+		return gzip.NewReader(section)
+	}
+	return section, nil
+}
+
+// Reads the segment lines between the offsets
+func (segment *logSegment) readRange(start int64, end int64) ([]byte, error) {
+	if segment.compressed {
+		reader, err := gzip.NewReader(io.NewSectionReader(segment.file, start, end-start))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(reader)
+	}
+	data := make([]byte, end-start)
+	if _, err := segment.file.ReadAt(data, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Removes the logs file with all its segments and indexes
+func removeLogs(filename string) error {
+	names, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, name := range append(names, filename) {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Returns the index entries of all the segments in the order of the segments
+func allEntries(segments []*logSegment) []segmentEntry {
+	entries := []segmentEntry{}
+	for i, segment := range segments {
+		for j := range segment.index {
+			entries = append(entries, segmentEntry{i, j})
+		}
+	}
+	return entries
+}
+
+func readForward(segments []*logSegment, from time.Time, afterSeq uint64, handle func(message *LogMessage) bool) error {
+	entries := allEntries(segments)
+
+	// All the lines before the entry are skipped if the entry time is before 'from', as
+	// the times never decrease, or if the entry follows the line with sequence number 'afterSeq'
+	skipBefore := func(entry indexEntry) bool {
+		return entry.Time.Before(from) || (afterSeq != 0 && entry.Seq <= afterSeq+1)
+	}
+	start := sort.Search(len(entries), func(i int) bool {
+		ref := entries[i]
+		return !skipBefore(segments[ref.segment].index[ref.entry])
+	}) - 1
+	if len(entries) == 0 {
+		return nil
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	for i := entries[start].segment; i < len(segments); i++ {
+		segment := segments[i]
+		offset := int64(0)
+		if i == entries[start].segment {
+			offset = segment.index[entries[start].entry].Offset
+		}
+		segmentReader, err := segment.readFrom(offset)
+		if err != nil {
+			return err
+		}
+		reader := bufio.NewReader(segmentReader)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF {
+				// The last line is not completely written yet
+				break
+			}
+			if err != nil {
+				return err
+			}
+			message := &LogMessage{}
+			if err := json.Unmarshal(line, message); err != nil {
+				return err
+			}
+			if message.Time.Before(from) || (afterSeq != 0 && message.Seq <= afterSeq) {
+				continue
+			}
+			if !handle(message) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func readBackward(segments []*logSegment, till time.Time, handle func(message *LogMessage) bool) error {
+	entries := allEntries(segments)
+
+	// The lines of the blocks which start after 'till' are after it as well
+	last := sort.Search(len(entries), func(i int) bool {
+		ref := entries[i]
+		return segments[ref.segment].index[ref.entry].Time.After(till)
+	}) - 1
+
+	for i := last; i >= 0; i-- {
+		segment := segments[entries[i].segment]
+		start := segment.index[entries[i].entry].Offset
+		end := segment.size
+		if entries[i].entry+1 < len(segment.index) {
+			end = segment.index[entries[i].entry+1].Offset
+		}
+		messages, err := readBlock(segment, start, end)
+		if err != nil {
+			return err
+		}
+		for j := len(messages) - 1; j >= 0; j-- {
+			if messages[j].Time.After(till) {
+				continue
+			}
+			if !handle(messages[j]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Reads the complete lines of the segment between the offsets
+func readBlock(segment *logSegment, start int64, end int64) ([]*LogMessage, error) {
+	data, err := segment.readRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+	messages := []*LogMessage{}
+	for {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			return messages, nil
+		}
+		message := &LogMessage{}
+		if err := json.Unmarshal(data[:idx], message); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+		data = data[idx+1:]
+	}
+}
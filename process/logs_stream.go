@@ -0,0 +1,232 @@
+package process
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/evoevodin/machine-agent/op"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often the comment is sent to the idle server-sent events stream,
+	// so the connection is not closed by proxies
+	sseKeepAlivePeriod = 15 * time.Second
+
+	// The kind of the text log line which describes the process death
+	diedKind = "DIED"
+)
+
+// The number of logs streams opened so far, used for subscriber ids
+var streamsCounter uint64
+
+// Writes the process logs to the http response either as
+// plain text lines or as server-sent events, flushing after each write
+type logsStream struct {
+	w          io.Writer
+	controller *http.ResponseController
+	sse        bool
+}
+
+// Streams the history logs and then the logs which appeared at or after the given time
+// and have sequence numbers greater than afterSeq, as they appear, until the process dies
+// or the client disconnects. When the process dies its status is written as the last line of the stream
+func streamLogs(w http.ResponseWriter, r *http.Request, p *MachineProcess, history []*LogMessage, mask uint64, from time.Time, afterSeq uint64, sse bool) error {
+	stream := &logsStream{w: w, controller: http.NewResponseController(w), sse: sse}
+
+	// The stream lasts as long as the process does, so it is not limited by the server write timeout
+	if err := stream.controller.SetWriteDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, message := range history {
+		if err := stream.writeMessage(message); err != nil {
+			return nil
+		}
+	}
+	if err := stream.flush(); err != nil {
+		return nil
+	}
+
+	events := make(chan *op.Event)
+	subscriber := &Subscriber{
+		Id:      fmt.Sprintf("logs-stream-%d", atomic.AddUint64(&streamsCounter, 1)),
+		Mask:    mask | ProcessStatusBit,
+		Channel: events,
+	}
+
+	// Restoring publishes the logs which appeared after the history,
+	// so they must be consumed while the restoring is in progress
+	restored := make(chan bool, 1)
+	restoring := true
+	defer func() {
+		// The events are published while the process lock is held, so they are drained
+		// until the subscriber is removed, otherwise the publishing and the removal wait for each other
+		removed := make(chan bool)
+		go func() {
+			for {
+				select {
+				case <-events:
+				case <-removed:
+					return
+				}
+			}
+		}()
+
+		// The subscriber which is added after it is removed would be left with the closed channel,
+		// so the removal waits for the restoring, the drained restoring doesn't block
+		if restoring {
+			<-restored
+		}
+		p.RemoveSubscriber(subscriber.Id)
+		close(removed)
+		close(events)
+	}()
+
+	go func() {
+		subscribed, err := p.restoreSubscriber(subscriber, from, afterSeq)
+		if err != nil {
+			log.Printf("Couldn't stream the logs of the process '%d'. %s", p.Pid, err.Error())
+		}
+		restored <- subscribed
+	}()
+
+	var keepAlive <-chan time.Time
+	if sse {
+		ticker := time.NewTicker(sseKeepAlivePeriod)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+
+	for {
+		var err error
+		select {
+		case event := <-events:
+			switch body := event.Body.(type) {
+			case *ProcessOutputEventBody:
+				err = stream.writeMessage(newEventLogMessage(event, body))
+			case *ProcessStatusEventBody:
+				if event.EventType == ProcessDiedEventType {
+					stream.writeDied(body)
+					return nil
+				}
+			}
+		case subscribed := <-restored:
+			restoring = false
+
+			// The process was dead before the subscriber is added,
+			// so the restored logs are the last ones
+			if !subscribed {
+				p.mutex.RLock()
+				body := p.newStatusEventBody()
+				body.Exit = p.Exit
+				alive := p.Alive
+				p.mutex.RUnlock()
+				if !alive {
+					stream.writeDied(body)
+				}
+				return nil
+			}
+		case <-keepAlive:
+			_, err = io.WriteString(stream.w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return nil
+		}
+		if err == nil {
+			err = stream.flush()
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (stream *logsStream) writeMessage(message *LogMessage) error {
+	if !stream.sse {
+		_, err := io.WriteString(stream.w, formatTextLog(message))
+		return err
+	}
+	eventType := StdoutEventType
+	if message.Kind == StderrKind {
+		eventType = StderrEventType
+	}
+	return stream.writeEvent(fmt.Sprintf("id: %d\nevent: %s\n", message.Seq, eventType), message)
+}
+
+func (stream *logsStream) writeDied(body *ProcessStatusEventBody) error {
+	var err error
+	if stream.sse {
+		err = stream.writeEvent(fmt.Sprintf("event: %s\n", ProcessDiedEventType), body)
+	} else {
+		_, err = io.WriteString(stream.w, formatTextDied(body.Exit))
+	}
+	if err != nil {
+		return err
+	}
+	return stream.flush()
+}
+
+func (stream *logsStream) writeEvent(header string, data interface{}) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(stream.w, header+"data: "+string(content)+"\n\n")
+	return err
+}
+
+func (stream *logsStream) flush() error {
+	return stream.controller.Flush()
+}
+
+// Creates the log message from the published output event
+func newEventLogMessage(event *op.Event, body *ProcessOutputEventBody) *LogMessage {
+	kind := StdoutKind
+	if event.EventType == StderrEventType {
+		kind = StderrKind
+	}
+	return &LogMessage{
+		Kind:     kind,
+		Time:     event.Time,
+		Text:     body.Text,
+		Seq:      body.Seq,
+		Encoding: body.Encoding,
+	}
+}
+
+// Formats the log message as the line of the text logs
+func formatTextLog(message *LogMessage) string {
+	return fmt.Sprintf("[%s] %s \t %s\n", message.Kind, message.Time.Format(DateTimeFormat), message.Line())
+}
+
+// Formats the process death as the line of the text logs,
+// the exit is nil if the process was lost
+func formatTextDied(exit *ExitInfo) string {
+	if exit == nil {
+		return fmt.Sprintf("[%s] %s \t Process is lost\n", diedKind, time.Now().Format(DateTimeFormat))
+	}
+	text := fmt.Sprintf("Process exited with code %d", exit.ExitCode)
+	if exit.Signal != "" {
+		text += ", terminated by " + exit.Signal
+	}
+	if exit.TimedOut {
+		text += ", timed out"
+	}
+	if exit.OomKilled {
+		text += ", out of memory"
+	}
+	if exit.PidsLimited {
+		text += ", reached pids limit"
+	}
+	return fmt.Sprintf("[%s] %s \t %s\n", diedKind, exit.EndTime.Format(DateTimeFormat), text)
+}
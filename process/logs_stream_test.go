@@ -0,0 +1,87 @@
+package process_test
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/evoevodin/machine-agent/process"
+	"github.com/evoevodin/machine-agent/rest"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFollowedLogsAreStreamedUntilProcessDies(t *testing.T) {
+	process.LogsDir = os.TempDir() + string(os.PathSeparator) + randomName(10)
+	defer os.RemoveAll(process.LogsDir)
+
+	p := process.NewProcess(process.Command{
+		Name:        "test",
+		CommandLine: "echo first; sleep 1; echo second >&2",
+		Type:        "test",
+	})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(newProcessRouter())
+	defer server.Close()
+	resp, err := http.Get(fmt.Sprintf("%s/process/%d/logs?follow=true", server.URL, p.Pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", resp.StatusCode)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 2 log lines and the status line, but got %q", lines)
+	}
+	if !strings.HasPrefix(lines[0], "[STDOUT]") || !strings.HasSuffix(lines[0], "first") {
+		t.Fatalf("Expected the first line to be stdout 'first', but got '%s'", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "[STDERR]") || !strings.HasSuffix(lines[1], "second") {
+		t.Fatalf("Expected the second line to be stderr 'second', but got '%s'", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "[DIED]") || !strings.HasSuffix(lines[2], "Process exited with code 0") {
+		t.Fatalf("Expected the last line to describe the process exit, but got '%s'", lines[2])
+	}
+}
+
+func TestLogsStreamIsClosedWhileOutputIsFlowing(t *testing.T) {
+	server := httptest.NewServer(newProcessRouter())
+	defer server.Close()
+
+	commandLine := "for i in $(seq 1 20000); do echo line $i; done"
+	startAndWait(t, process.Command{Name: "test", CommandLine: commandLine, Type: "test"}, func(p *process.MachineProcess) {
+		resp, err := http.Get(fmt.Sprintf("%s/process/%d/logs?follow=true", server.URL, p.Pid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+
+		// The process keeps publishing its output after the client disconnects,
+		// so it dies in time only if the stream subscriber is removed
+		resp.Body.Close()
+	})
+	defer os.RemoveAll(process.LogsDir)
+}
+
+func newProcessRouter() *mux.Router {
+	router := mux.NewRouter()
+	for _, route := range process.HttpRoutes.Items {
+		router.Methods(route.Method).Path(route.Path).HandlerFunc(rest.ToHttpHandlerFunc(route.HandleFunc))
+	}
+	return router
+}
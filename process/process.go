@@ -1,26 +1,35 @@
 package process
 
 import (
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/evoevodin/machine-agent/op"
+	"io"
+	"log"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 const (
 	StdoutBit        = 1 << iota
 	StderrBit        = 1 << iota
 	ProcessStatusBit = 1 << iota
+	StatsBit         = 1 << iota
 	DefaultMask      = StderrBit | StdoutBit | ProcessStatusBit
 
 	DateTimeFormat = time.RFC3339Nano
 
+	// How long timed out process may handle SIGTERM before it is killed
+	TimeoutGracePeriod = 10 * time.Second
+
 	StdoutKind = "STDOUT"
 	StderrKind = "STDERR"
 )
@@ -36,6 +45,68 @@ type Command struct {
 	Name        string `json:"name"`
 	CommandLine string `json:"commandLine"`
 	Type        string `json:"type"`
+
+	// Environment variables of the command e.g. {"MAVEN_OPTS" : "-Xmx1g"}
+	Env map[string]string `json:"env"`
+
+	// Defines how Env is applied, either 'merge'(default) which
+	// merges Env with the agent's environment or 'replace' which
+	// uses only Env as the command environment
+	EnvMode string `json:"envMode"`
+
+	// The working directory of the command, if empty
+	// then the agent's working directory is used
+	WorkingDir string `json:"workingDir"`
+
+	// The shell which interprets the command line, default is 'sh'
+	Shell string `json:"shell"`
+
+	// If specified the command is executed directly without shell interpretation,
+	// the first item is the program and the rest are its arguments
+	Argv []string `json:"argv"`
+
+	// The time in seconds after which the process group is terminated,
+	// 0 means that the process may run infinitely
+	Timeout int `json:"timeout"`
+
+	// Resources available for the process, nil means no limits
+	Limits *ResourceLimits `json:"limits"`
+
+	// Defines how much of the process logs is kept on disk,
+	// nil means that the agent defaults are used
+	Logs *LogsLimits `json:"logs"`
+
+	// Whether the process is kept with its logs after it is dead,
+	// until it is explicitly discarded, see Cleaner
+	Keep bool `json:"keep"`
+
+	// The secrets which are masked in the process output in addition
+	// to the secrets declared by the agent, nil means only the agent's secrets
+	Secrets *Secrets `json:"secrets"`
+
+	// Whether the command is run in the pseudo-terminal, if so
+	// its stdout and stderr are merged and published as stdout
+	Tty bool `json:"tty"`
+
+	// The name or id of the user which the command is run as,
+	// the agent's user by default
+	User string `json:"user"`
+
+	// The name or id of the primary group which the command is run with,
+	// the primary group of the user by default
+	Group string `json:"group"`
+
+	// Names or ids of the supplementary groups, by default these are
+	// the groups which the user is a member of according to /etc/group
+	Groups []string `json:"groups"`
+
+	// Defines whether the process is relaunched after it finished,
+	// nil means that the process is never restarted
+	Restart *RestartPolicy `json:"restart"`
+
+	// Defines how to detect that the process is ready,
+	// nil means that the readiness is not detected
+	Readiness *ReadinessProbe `json:"readiness"`
 }
 
 // Defines machine process model
@@ -61,27 +132,122 @@ type MachineProcess struct {
 	// Whether this process is alive or dead
 	Alive bool `json:"alive"`
 
+	// Whether this process is suspended with SIGSTOP
+	Paused bool `json:"paused"`
+
+	// Whether this process was terminated because its timeout was reached
+	TimedOut bool `json:"timedOut"`
+
+	// How many times the process was restarted according to its restart policy
+	Restarts int `json:"restarts"`
+
+	// Whether the current process run was detected as ready by the readiness probe
+	Ready bool `json:"ready"`
+
+	// Whether the process was alive when the agent was stopped
+	// and it was not possible to re-adopt it after the agent restart
+	Lost bool `json:"lost"`
+
+	// Whether the process is not started by the agent but adopted,
+	// the output of such process is not captured
+	Adopted bool `json:"adopted"`
+
+	// Whether the process is never removed by the cleaner, see Cleaner
+	Keep bool `json:"keep"`
+
+	// The number of the secrets masked in the process output
+	Redactions uint64 `json:"redactions"`
+
 	// The native(OS) pid, it is unique per alive processes,
 	// but those which are not alive, may have the same NativePid
 	NativePid int `json:"nativePid"`
 
+	// When the process was started
+	StartTime time.Time `json:"startTime"`
+
+	// Describes how the process finished, the value
+	// is nil while the process is alive
+	Exit *ExitInfo `json:"exit,omitempty"`
+
 	// Process log filename
 	logfileName string
 
+	// Masks the secrets in the process output, nil if there are no secrets
+	masker *secretsMasker
+
+	// The command which this process is created from
+	source Command
+
 	// Command executed by this process.
 	// If process is not alive then the command value is set to nil
 	command *exec.Cmd
 
+	// The cgroup which limits the process group, nil if
+	// the process is not limited with cgroup.
+	// If process is not alive then the cgroup value is set to nil
+	cgroup *processCgroup
+
 	// Stdout/stderr pumper.
 	// If process is not alive then the pumper value is set to nil
 	pumper *LogsPumper
 
+	// The master of the pseudo-terminal which the process is run in,
+	// nil if the process is not run in the terminal.
+	// If process is not alive then the tty value is set to nil
+	tty *os.File
+
+	// Process stdin.
+	// If process is not alive or its stdin is closed then the stdin value is set to nil
+	stdin io.WriteCloser
+
+	// Guards stdin writes, so the input written by different clients is not mixed
+	stdinMutex sync.Mutex
+
+	// Whether the stdin of the current process run is closed with CloseInput
+	stdinClosed bool
+
+	// The signal which was sent to kill the process, 0 if the process wasn't killed
+	killSignal syscall.Signal
+
+	// Sends SIGKILL when the grace period of the kill is over.
+	// If process is not alive then the timer is stopped
+	killTimer *time.Timer
+
+	// Terminates the process when the command timeout is reached.
+	// If process is not alive then the timer is stopped
+	timeoutTimer *time.Timer
+
+	// Checks the readiness of the current process run,
+	// nil if the command doesn't define the readiness probe
+	readiness *readinessCheck
+
+	// Whether the process finished and is waiting to be relaunched
+	restarting bool
+
+	// The number of the restarts since the process run long enough
+	// to reset the restart backoff
+	backoffAttempt int
+
+	// Cancels waiting for the restart when the process is killed
+	restartCancel chan bool
+
 	// Process subscribers, all the outgoing events are go through those subscribers.
 	// If process is not alive then the subscribers value is set to nil
 	subs []*Subscriber
 
-	// Process file logger
-	fileLogger *FileLogger
+	// Stores the process output, nil if the output is not
+	// captured e.g. the process is re-adopted or loaded from the registry
+	logs LogsStore
+
+	// Serializes numbering, logging and publishing of the output lines,
+	// so the lines are written and published in the order of their numbers
+	outputMutex sync.Mutex
+
+	// The sequence number of the last output line
+	lastSeq uint64
+
+	// The time of the last output line, the output times never decrease
+	lastOutputTime time.Time
 
 	mutex sync.RWMutex
 
@@ -93,6 +259,89 @@ type MachineProcess struct {
 	beforeEventsHook func(process *MachineProcess)
 }
 
+// Describes the termination of the machine process
+type ExitInfo struct {
+	// The exit code of the process, -1 if the process
+	// was terminated by a signal
+	ExitCode int `json:"exitCode"`
+
+	// The name of the signal which terminated the process e.g. 'SIGKILL',
+	// empty if the process exited normally
+	Signal string `json:"signal,omitempty"`
+
+	// When the process finished
+	EndTime time.Time `json:"endTime"`
+
+	// How long the process was running(in milliseconds)
+	Duration int64 `json:"duration"`
+
+	// Resources used by the process and its waited children
+	Usage ResourceUsage `json:"usage"`
+
+	// The name of the signal sent by the agent to kill the process e.g. 'SIGTERM',
+	// empty if the process wasn't killed by the agent
+	KillSignal string `json:"killSignal,omitempty"`
+
+	// Whether the process was killed because its timeout was reached
+	TimedOut bool `json:"timedOut,omitempty"`
+
+	// Whether any process of the process group was killed
+	// because the memory limit was exceeded
+	OomKilled bool `json:"oomKilled,omitempty"`
+
+	// Whether any process of the process group failed to create
+	// a process or thread because the pids limit was reached
+	PidsLimited bool `json:"pidsLimited,omitempty"`
+}
+
+// Describes resources used by the finished process
+type ResourceUsage struct {
+	// User CPU time(in milliseconds)
+	UserTime int64 `json:"userTime"`
+
+	// System CPU time(in milliseconds)
+	SystemTime int64 `json:"systemTime"`
+
+	// Maximum resident set size(in kilobytes)
+	MaxRss int64 `json:"maxRss"`
+}
+
+// Returned when the operation can't be performed because the process is not alive
+type NotAliveError struct {
+	Pid uint64
+}
+
+func (e *NotAliveError) Error() string {
+	return fmt.Sprintf("Process with id '%d' is not alive", e.Pid)
+}
+
+type AliveError struct {
+	Pid uint64
+}
+
+func (e *AliveError) Error() string {
+	return fmt.Sprintf("Process with id '%d' is alive", e.Pid)
+}
+
+// Returned when the operation can't be performed because the process
+// finished and is waiting to be relaunched, so there is no native process
+type RestartingError struct {
+	Pid uint64
+}
+
+func (e *RestartingError) Error() string {
+	return fmt.Sprintf("Process with id '%d' is restarting", e.Pid)
+}
+
+// Returned when the input is written to the alive process which stdin is closed
+type InputClosedError struct {
+	Pid uint64
+}
+
+func (e *InputClosedError) Error() string {
+	return fmt.Sprintf("Input of process with id '%d' is closed", e.Pid)
+}
+
 type Subscriber struct {
 	Id      string
 	Mask    uint64
@@ -103,6 +352,14 @@ type LogMessage struct {
 	Kind string    `json:"kind"`
 	Time time.Time `json:"time"`
 	Text string    `json:"text"`
+
+	// The number of the line in the process output, the numbering starts
+	// from 1 and continues across the process restarts
+	Seq uint64 `json:"seq"`
+
+	// Either empty which means that the text is as is,
+	// or 'base64' if the line is not valid UTF-8 and the text is base64 encoded
+	Encoding string `json:"encoding,omitempty"`
 }
 
 // Lockable map for storing processes
@@ -118,10 +375,16 @@ func init() {
 }
 
 func NewProcess(newCommand Command) *MachineProcess {
+	commandLine := newCommand.CommandLine
+	if commandLine == "" {
+		commandLine = strings.Join(newCommand.Argv, " ")
+	}
 	return &MachineProcess{
 		Name:        newCommand.Name,
-		CommandLine: newCommand.CommandLine,
+		CommandLine: commandLine,
 		Type:        newCommand.Type,
+		Keep:        newCommand.Keep,
+		source:      newCommand,
 	}
 }
 
@@ -134,87 +397,192 @@ func (process *MachineProcess) BeforeEventsHook(f func(p *MachineProcess)) *Mach
 }
 
 func (process *MachineProcess) Start() error {
-	// wrap command to be able to kill child processes see https://github.com/golang/go/issues/8854
-	cmd := exec.Command("setsid", "sh", "-c", process.CommandLine)
-
-	// getting stdout pipe
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-
-	// getting stderr pipe
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return err
-	}
-
-	// starting a new process
-	err = cmd.Start()
-	if err != nil {
-		return err
-	}
-
 	// increment current pid & assign it to the value
 	pid := atomic.AddUint64(&prevPid, 1)
 
-	// Figure out the place for logs file
-	dir, err := logsDist.DirForPid(LogsDir, pid)
+	filename, logs, err := newProcessLogger(pid, process.source.Logs)
 	if err != nil {
+		releasePid(pid)
 		return err
 	}
-	filename := fmt.Sprintf("%s%cpid-%d", dir, os.PathSeparator, pid)
 
-	fileLogger, err := NewLogger(filename)
-	if err != nil {
+	process.Pid = pid
+	process.logfileName = filename
+	process.logs = logs
+	process.masker = newSecretsMasker(process.source)
+	if err := process.launch(); err != nil {
+		logs.Close()
+		removeLogs(filename)
+		releasePid(pid)
 		return err
 	}
 
 	// save process
-	process.Pid = pid
 	process.Alive = true
-	process.NativePid = cmd.Process.Pid
-	process.command = cmd
-	process.pumper = NewPumper(stdout, stderr)
-	process.logfileName = filename
-	process.fileLogger = fileLogger
 	process.lastUsed = time.Now()
 
 	processes.Lock()
 	processes.items[pid] = process
 	processes.Unlock()
 
-	// register logs consumers
-	process.pumper.AddConsumer(fileLogger)
-	process.pumper.AddConsumer(process)
-
 	if process.beforeEventsHook != nil {
 		process.beforeEventsHook(process)
 	}
+	process.persist()
 
 	// before pumping is started publish process_started event
 	startPublished := make(chan bool)
-	go func () {
-		body := &ProcessStatusEventBody{
-			ProcessEventBody: ProcessEventBody{Pid: process.Pid},
-			NativePid:        process.NativePid,
-			Name:             process.Name,
-			CommandLine:      process.CommandLine,
-		}
-		process.notifySubs(op.NewEventNow(ProcessStartedEventType, body), ProcessStatusBit)
+	go func() {
+		process.notifySubs(op.NewEventNow(ProcessStartedEventType, process.newStatusEventBody()), ProcessStatusBit)
 		startPublished <- true
-	}();
+	}()
 
+	go process.publishStats()
 
 	// start pumping after start event is published 'pumper.Pump' is blocking
 	go func() {
-		<- startPublished
-		process.pumper.Pump()
+		<-startPublished
+		process.pump()
 	}()
 
 	return nil
 }
 
+// Gives back the pid taken for the process which failed to start, so the failure
+// doesn't leave a gap in the ids. The pid is given back only if no pid is taken after it
+func releasePid(pid uint64) {
+	atomic.CompareAndSwapUint64(&prevPid, pid, pid-1)
+}
+
+// Creates the logs file for the process with the given pid and returns its name
+// and the store which writes to it with the given limits and keeps the recent logs in memory
+func newProcessLogger(pid uint64, limits *LogsLimits) (string, LogsStore, error) {
+	// Figure out the place for logs file
+	dir, err := logsDist.DirForPid(LogsDir, pid)
+	if err != nil {
+		return "", nil, err
+	}
+	filename := fmt.Sprintf("%s%cpid-%d", dir, os.PathSeparator, pid)
+
+	fileLogger, err := NewLimitedLogger(filename, limits)
+	if err != nil {
+		return "", nil, err
+	}
+	return filename, NewBufferedLogs(fileLogger, LogsBufferSize), nil
+}
+
+// Executes the command of this process, this method is called once
+// when the process is started and then each time the process is restarted.
+// Pumping is not started by this method
+func (process *MachineProcess) launch() error {
+	cmd, err := newExecCmd(process.source)
+	if err != nil {
+		return err
+	}
+
+	// The output of the process run in the terminal is merged into stdout
+	var stdout, stderr io.Reader
+	var stdin io.WriteCloser
+	var tty, ttySlave *os.File
+	if process.source.Tty {
+		if tty, ttySlave, err = openTty(cmd); err != nil {
+			return err
+		}
+		defer ttySlave.Close()
+		stdout = &ptyReader{tty}
+		stderr = strings.NewReader("")
+		stdin = &ptyWriter{tty}
+	} else {
+		// getting stdout pipe
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return err
+		}
+
+		// getting stderr pipe
+		if stderr, err = cmd.StderrPipe(); err != nil {
+			return err
+		}
+
+		// getting stdin pipe
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return err
+		}
+	}
+
+	// Create the process cgroup if it is needed for limiting
+	// the process, the process is started right in the cgroup
+	cgroup, err := newProcessCgroup(process.Pid, process.source.Limits)
+	if err != nil {
+		closeTty(tty)
+		return err
+	}
+	if cgroup != nil {
+		cgroupDir, err := startInCgroup(cmd, cgroup)
+		if err != nil {
+			cgroup.remove()
+			closeTty(tty)
+			return err
+		}
+		defer cgroupDir.Close()
+	}
+
+	// starting a new process
+	err = cmd.Start()
+	if err != nil {
+		if cgroup != nil {
+			cgroup.remove()
+		}
+		closeTty(tty)
+		return err
+	}
+
+	pumper := NewPumper(stdout, stderr)
+	if process.masker != nil {
+		pumper.SetSplitLimit(process.masker.splitPosition)
+	}
+
+	// The readiness check must be closed before the process is closed,
+	// as the process may be relaunched right after it is closed
+	var readiness *readinessCheck
+	if process.source.Readiness != nil {
+		readiness = newReadinessCheck(process, process.source.Readiness)
+		pumper.AddConsumer(readiness)
+	}
+	pumper.AddConsumer(process)
+
+	process.mutex.Lock()
+	process.NativePid = cmd.Process.Pid
+	process.StartTime = time.Now()
+	process.command = cmd
+	process.cgroup = cgroup
+	process.pumper = pumper
+	process.readiness = readiness
+	process.tty = tty
+	process.Ready = false
+	if process.source.Timeout > 0 {
+		process.timeoutTimer = time.AfterFunc(time.Duration(process.source.Timeout)*time.Second, process.onTimeout)
+	}
+	process.mutex.Unlock()
+
+	process.stdinMutex.Lock()
+	process.stdin = stdin
+	process.stdinClosed = false
+	process.stdinMutex.Unlock()
+	return nil
+}
+
+// Starts the readiness check and pumping of the current process run,
+// the method is blocking until pumping is finished
+func (process *MachineProcess) pump() {
+	process.mutex.RLock()
+	pumper, readiness := process.pumper, process.readiness
+	process.mutex.RUnlock()
+	if readiness != nil {
+		readiness.start()
+	}
+	pumper.Pump()
+}
+
 func Get(pid uint64) (*MachineProcess, bool) {
 	processes.RLock()
 	defer processes.RUnlock()
@@ -235,20 +603,231 @@ func GetProcesses(all bool) []*MachineProcess {
 	return pArr
 }
 
+// Finds an alive process by its native pid
+func GetByNativePid(nativePid int) (*MachineProcess, bool) {
+	processes.RLock()
+	defer processes.RUnlock()
+	return findByNativePid(nativePid)
+}
+
+// Must be called with the processes lock held
+func findByNativePid(nativePid int) (*MachineProcess, bool) {
+	for _, v := range processes.items {
+		if v.Alive && v.NativePid == nativePid {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Kills the process group with SIGKILL
 func (mp *MachineProcess) Kill() error {
+	return mp.KillWithSignal(syscall.SIGKILL, 0)
+}
+
+// Sends the signal to the process group. If the grace period is positive
+// and the process group is still alive after it then SIGKILL is sent.
+// Only SIGKILL, SIGTERM and the signals escalated after the grace period kill the process,
+// such process is never restarted, the other signals e.g. SIGHUP are just delivered.
+// Returns NotAliveError if the process is dead and RestartingError
+// if the signal doesn't kill the process which is waiting to be relaunched
+func (mp *MachineProcess) KillWithSignal(sig syscall.Signal, grace time.Duration) error {
+	resumed, err := mp.sendSignal(sig, grace)
+	if resumed {
+		mp.onPausedChanged(ProcessResumedEventType)
+	}
+	return err
+}
+
+// Sends the signal for KillWithSignal, returns true if the paused process group
+// is resumed, so the signal can be handled
+func (mp *MachineProcess) sendSignal(sig syscall.Signal, grace time.Duration) (bool, error) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if !mp.Alive {
+		return false, &NotAliveError{mp.Pid}
+	}
+	kill := sig == syscall.SIGKILL || sig == syscall.SIGTERM || grace > 0
+
+	// The process is waiting for the restart, so there is nothing
+	// to send the signal to, the restart is cancelled instead
+	if mp.restarting {
+		if !kill {
+			return false, &RestartingError{mp.Pid}
+		}
+		mp.killSignal = sig
+		select {
+		case mp.restartCancel <- true:
+		default:
+		}
+		return false, nil
+	}
+
+	// The signal is set before it is sent, as the process which finishes concurrently
+	// must not be restarted, in this case sending fails with ESRCH and the kill is still requested
+	prevSignal := mp.killSignal
+	if kill {
+		mp.killSignal = sig
+	}
+
 	// workaround for killing child processes see https://github.com/golang/go/issues/8854
-	return syscall.Kill(-mp.NativePid, syscall.SIGKILL)
+	if err := mp.signal(sig); err == syscall.ESRCH {
+		return false, nil
+	} else if err != nil {
+		mp.killSignal = prevSignal
+		return false, err
+	}
+
+	// Paused process group can't handle any signal but SIGKILL, so resume it
+	resumed := false
+	if mp.Paused && sig != syscall.SIGKILL {
+		if err := mp.signal(syscall.SIGCONT); err != nil {
+			return false, err
+		}
+		mp.Paused = false
+		mp.lastUsed = time.Now()
+		resumed = true
+	}
+
+	if grace > 0 && sig != syscall.SIGKILL && mp.killTimer == nil {
+		mp.killTimer = time.AfterFunc(grace, func() {
+			mp.mutex.RLock()
+			defer mp.mutex.RUnlock()
+			if mp.Alive {
+				mp.signal(syscall.SIGKILL)
+			}
+		})
+	}
+	return resumed, nil
 }
 
-func (mp *MachineProcess) ReadLogs(from time.Time, till time.Time) ([]*LogMessage, error) {
+// Writes the given data to the process stdin.
+// Returns NotAliveError if the process is dead, InputClosedError if its stdin
+// is closed and RestartingError if the process is waiting to be relaunched
+func (mp *MachineProcess) WriteInput(data []byte) error {
+	mp.stdinMutex.Lock()
+	defer mp.stdinMutex.Unlock()
+	if mp.stdin == nil {
+		return mp.noInputError()
+	}
+	_, err := mp.stdin.Write(data)
+	return err
+}
+
+// Closes the process stdin, so the process receives EOF.
+// Returns NotAliveError if the process is dead, InputClosedError if its stdin
+// is already closed and RestartingError if the process is waiting to be relaunched
+func (mp *MachineProcess) CloseInput() error {
+	mp.stdinMutex.Lock()
+	defer mp.stdinMutex.Unlock()
+	if mp.stdin == nil {
+		return mp.noInputError()
+	}
+	err := mp.stdin.Close()
+	mp.stdin = nil
+	mp.stdinClosed = true
+	return err
+}
+
+// Returns the error which describes why the process has no stdin,
+// must be called with the stdin mutex held
+func (mp *MachineProcess) noInputError() error {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+	if mp.Alive && mp.restarting {
+		return &RestartingError{mp.Pid}
+	}
+	if mp.Alive && mp.stdinClosed {
+		return &InputClosedError{mp.Pid}
+	}
+	return &NotAliveError{mp.Pid}
+}
+
+// Suspends the process group with SIGSTOP and publishes process_paused event.
+// Suspending of the paused process does nothing.
+// Returns NotAliveError if the process is dead and RestartingError if it is waiting to be relaunched
+func (mp *MachineProcess) Suspend() error {
+	return mp.setPaused(true, syscall.SIGSTOP, ProcessPausedEventType)
+}
+
+// Resumes the suspended process group with SIGCONT and publishes process_resumed event.
+// Resuming of the process which is not paused does nothing.
+// Returns NotAliveError if the process is dead and RestartingError if it is waiting to be relaunched
+func (mp *MachineProcess) Resume() error {
+	return mp.setPaused(false, syscall.SIGCONT, ProcessResumedEventType)
+}
+
+// Marks the process as timed out, publishes process_timed_out
+// event and terminates the process group
+func (mp *MachineProcess) onTimeout() {
 	mp.mutex.Lock()
+	if !mp.Alive {
+		mp.mutex.Unlock()
+		return
+	}
+	mp.TimedOut = true
+	mp.mutex.Unlock()
+
+	mp.notifySubs(op.NewEventNow(ProcessTimedOutEventType, mp.newStatusEventBody()), ProcessStatusBit)
+	if err := mp.KillWithSignal(syscall.SIGTERM, TimeoutGracePeriod); err != nil {
+		log.Printf("Couldn't terminate timed out process '%d'. %s", mp.Pid, err.Error())
+	}
+}
+
+func (mp *MachineProcess) setPaused(paused bool, sig syscall.Signal, eventType string) error {
+	mp.mutex.Lock()
+	if !mp.Alive {
+		mp.mutex.Unlock()
+		return &NotAliveError{mp.Pid}
+	}
+	if mp.restarting {
+		mp.mutex.Unlock()
+		return &RestartingError{mp.Pid}
+	}
+	if mp.Paused == paused {
+		mp.mutex.Unlock()
+		return nil
+	}
+	if err := mp.signal(sig); err != nil {
+		mp.mutex.Unlock()
+		return err
+	}
+	mp.Paused = paused
 	mp.lastUsed = time.Now()
 	mp.mutex.Unlock()
-	fl := mp.fileLogger
-	if mp.Alive {
-		fl.Flush()
+	mp.onPausedChanged(eventType)
+	return nil
+}
+
+// Persists the paused state of the process and publishes either process_paused or process_resumed event
+func (mp *MachineProcess) onPausedChanged(eventType string) {
+	mp.persist()
+	mp.notifySubs(op.NewEventNow(eventType, mp.newStatusEventBody()), ProcessStatusBit)
+}
+
+// Reads the logs which appeared between [from, till] inclusive
+func (mp *MachineProcess) ReadLogs(from time.Time, till time.Time) ([]*LogMessage, error) {
+	return readLogsRange(mp.logsSource(), from, till)
+}
+
+// Reads at most limit latest logs of the kinds included into the mask, which appeared
+// between [from, till] and have sequence numbers greater than afterSeq, the skip latest
+// of such logs are skipped. The logs are returned from the earliest to the latest
+func (mp *MachineProcess) ReadLastLogs(from time.Time, till time.Time, afterSeq uint64, mask uint64, limit int, skip int) ([]*LogMessage, error) {
+	return readLastLogs(mp.logsSource(), from, till, afterSeq, mask, limit, skip)
+}
+
+// Returns the source of the process logs and marks the process as used
+func (mp *MachineProcess) logsSource() LogsSource {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.lastUsed = time.Now()
+
+	// Re-adopted processes don't have the store as their output is not pumped
+	if mp.logs != nil {
+		return mp.logs
 	}
-	return NewLogsReader(mp.logfileName).From(from).Till(till).ReadLogs()
+	return NewLogsReader(mp.logfileName)
 }
 
 func (mp *MachineProcess) RemoveSubscriber(id string) {
@@ -278,40 +857,74 @@ func (mp *MachineProcess) AddSubscriber(subscriber *Subscriber) error {
 	return nil
 }
 
-// Adds a new process subscriber by reading all the logs between
-// given 'after' and now and publishing them to the channel
+// Adds a new process subscriber and publishes to it all the logs
+// which appeared after the given time
 func (mp *MachineProcess) RestoreSubscriber(subscriber *Subscriber, after time.Time) error {
-	mp.mutex.Lock()
-	defer mp.mutex.Unlock()
+	_, err := mp.restoreSubscriber(subscriber, after.Add(time.Nanosecond), 0)
+	return err
+}
 
-	mp.lastUsed = time.Now()
+// Adds a new process subscriber and publishes to it all the logs
+// which sequence numbers are greater than the given one
+func (mp *MachineProcess) RestoreSubscriberAfterSeq(subscriber *Subscriber, seq uint64) error {
+	_, err := mp.restoreSubscriber(subscriber, time.Time{}, seq)
+	return err
+}
 
-	// Read logs between after and now
-	logs, err := mp.ReadLogs(after, time.Now())
-	if err != nil {
-		return err
-	}
+// Adds the subscriber and publishes to it the logs which appeared at or after the given time
+// and have sequence numbers greater than afterSeq. The output is not published while the logs
+// are restored, so the subscriber gets each line exactly once either from the logs or as an output event.
+// Returns true if the subscriber is added, which happens only if the process is alive
+func (mp *MachineProcess) restoreSubscriber(subscriber *Subscriber, from time.Time, afterSeq uint64) (bool, error) {
+	mp.outputMutex.Lock()
+	defer mp.outputMutex.Unlock()
 
 	// If process is dead there is no need to subscribe to it
 	// as it is impossible to get it alive again, but it is still
 	// may be useful for client to get missed logs, that's why this
 	// function doesn't throw any errors in the case of dead process
-	if mp.Alive {
+	source := mp.logsSource()
+	mp.mutex.Lock()
+	subscribed := mp.Alive
+	if subscribed {
 		for _, sub := range mp.subs {
 			if sub.Id == subscriber.Id {
-				return errors.New("Already subscribed")
+				mp.mutex.Unlock()
+				return false, errors.New("Already subscribed")
 			}
 		}
 		mp.subs = append(mp.subs, subscriber)
 	}
+	mp.mutex.Unlock()
 
-	// Publish all the logs between (after, now]
-	for i := 1; i < len(logs); i++ {
-		message := logs[i]
-		subscriber.Channel <- newOutputEvent(mp.Pid, message.Kind, message.Text, message.Time)
+	closed := false
+	err := source.ReadForward(from, afterSeq, func(message *LogMessage) bool {
+		if !isOfKinds(message, subscriber.Mask) {
+			return true
+		}
+		closed = !tryWrite(subscriber.Channel, newOutputEvent(mp.Pid, message))
+		return !closed
+	})
+
+	// The channel is closed, so the subscriber is not interested in the events anymore
+	if (err != nil || closed) && subscribed {
+		mp.RemoveSubscriber(subscriber.Id)
+		subscribed = false
 	}
+	return subscribed, err
+}
 
-	return nil
+// Returns true if there is at least one subscriber
+// interested in the events of the given type
+func (mp *MachineProcess) hasSubscriber(typeBit uint64) bool {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+	for _, sub := range mp.subs {
+		if sub.Mask&typeBit == typeBit {
+			return true
+		}
+	}
+	return false
 }
 
 func (mp *MachineProcess) UpdateSubscriber(id string, newMask uint64) error {
@@ -330,30 +943,180 @@ func (mp *MachineProcess) UpdateSubscriber(id string, newMask uint64) error {
 }
 
 func (process *MachineProcess) OnStdout(line string, time time.Time) {
-	process.notifySubs(newOutputEvent(process.Pid, StdoutEventType, line, time), StdoutBit)
+	process.onOutput(newLogMessage(StdoutKind, time, process.maskSecrets(line)), StdoutBit)
 }
 
 func (process *MachineProcess) OnStderr(line string, time time.Time) {
-	process.notifySubs(newOutputEvent(process.Pid, StderrEventType, line, time), StderrBit)
+	process.onOutput(newLogMessage(StderrKind, time, process.maskSecrets(line)), StderrBit)
+}
+
+// Masks the secrets in the output line and counts the redactions
+func (mp *MachineProcess) maskSecrets(line string) string {
+	if mp.masker == nil {
+		return line
+	}
+	masked, count := mp.masker.mask(line)
+	if count != 0 {
+		mp.mutex.Lock()
+		mp.Redactions += uint64(count)
+		mp.mutex.Unlock()
+	}
+	return masked
+}
+
+// Numbers the output line, writes it to the logs and publishes it to the subscribers
+func (mp *MachineProcess) onOutput(message *LogMessage, typeBit uint64) {
+	mp.outputMutex.Lock()
+	defer mp.outputMutex.Unlock()
+	mp.lastSeq++
+	message.Seq = mp.lastSeq
+	if message.Time.Before(mp.lastOutputTime) {
+		message.Time = mp.lastOutputTime
+	}
+	mp.lastOutputTime = message.Time
+	mp.logs.Append(message)
+	mp.notifySubs(newOutputEvent(mp.Pid, message), typeBit)
 }
 
 func (mp *MachineProcess) Close() {
-	// Cleanup command resources
+	// The output is fully pumped, so all the logs can be written
+	mp.logs.Flush()
+
+	// Cleanup command resources, the error is ignored as
+	// the exit status is taken from the process state
 	mp.command.Wait()
-	// Cleanup machine process resources before dead event is sent
+	exit := newExitInfo(mp.command.ProcessState, mp.StartTime, time.Now())
+	if mp.cgroup != nil {
+		exit.OomKilled = mp.cgroup.oomKilled()
+		exit.PidsLimited = mp.cgroup.pidsLimited()
+		mp.cgroup.remove()
+	}
+
+	// Wait closes the stdin pipe, so it is not possible to write to it anymore
+	mp.stdinMutex.Lock()
+	mp.stdin = nil
+	mp.stdinMutex.Unlock()
+
+	// The output is fully pumped, so the terminal is not needed anymore
 	mp.mutex.Lock()
-	mp.lastUsed = time.Now()
-	mp.Alive = false
+	closeTty(mp.tty)
+	mp.tty = nil
+	mp.mutex.Unlock()
+
+	// Cleanup command resources before the process is either restarted or dead
+	mp.mutex.Lock()
+	if mp.killSignal != 0 {
+		exit.KillSignal = signalName(mp.killSignal)
+	}
+	if mp.killTimer != nil {
+		mp.killTimer.Stop()
+		mp.killTimer = nil
+	}
+	if mp.timeoutTimer != nil {
+		mp.timeoutTimer.Stop()
+		mp.timeoutTimer = nil
+	}
+	exit.TimedOut = mp.TimedOut
+	mp.Paused = false
 	mp.command = nil
+	mp.cgroup = nil
 	mp.pumper = nil
+	mp.readiness = nil
+
+	// Processes killed by the agent are never restarted
+	policy := mp.source.Restart
+	if policy != nil && mp.killSignal == 0 && !mp.TimedOut && policy.shouldRestart(exit, mp.Restarts) {
+		// The process which run long enough is restarted as if it failed for the first time
+		if exit.EndTime.Sub(mp.StartTime) >= RestartBackoffResetPeriod {
+			mp.backoffAttempt = 0
+		}
+		mp.backoffAttempt++
+		mp.Restarts++
+		mp.restarting = true
+		mp.restartCancel = make(chan bool, 1)
+		attempt := mp.Restarts
+		delay := policy.backoff(mp.backoffAttempt)
+		mp.mutex.Unlock()
+		go mp.restart(attempt, delay, exit)
+		return
+	}
 	mp.mutex.Unlock()
 
-	body := &ProcessStatusEventBody{
-		ProcessEventBody: ProcessEventBody{Pid: mp.Pid},
-		NativePid:        mp.NativePid,
-		Name:             mp.Name,
-		CommandLine:      mp.CommandLine,
+	mp.die(exit)
+}
+
+// Relaunches the process after the backoff delay and publishes process_restarted event.
+// If the process is killed while waiting or it is impossible to relaunch it then it dies
+func (mp *MachineProcess) restart(attempt int, delay time.Duration, prevExit *ExitInfo) {
+	select {
+	case <-time.After(delay):
+	case <-mp.restartCancel:
+	}
+
+	mp.mutex.RLock()
+	killed := mp.killSignal != 0
+	mp.mutex.RUnlock()
+
+	if !killed {
+		err := mp.launch()
+		if err == nil {
+			mp.mutex.Lock()
+			mp.restarting = false
+			sig := mp.killSignal
+			mp.mutex.Unlock()
+
+			// The process was killed while it was launched
+			if sig != 0 {
+				mp.KillWithSignal(sig, 0)
+			}
+
+			mp.persist()
+			body := mp.newStatusEventBody()
+			body.Attempt = attempt
+			body.Exit = prevExit
+			mp.notifySubs(op.NewEventNow(ProcessRestartedEventType, body), ProcessStatusBit)
+			go mp.pump()
+			return
+		}
+		log.Printf("Couldn't restart process '%d'. %s", mp.Pid, err.Error())
+	}
+
+	mp.mutex.Lock()
+	mp.restarting = false
+	if mp.killSignal != 0 {
+		prevExit.KillSignal = signalName(mp.killSignal)
 	}
+	mp.mutex.Unlock()
+	mp.die(prevExit)
+}
+
+// Marks the process as dead and publishes process_died event
+func (mp *MachineProcess) die(exit *ExitInfo) {
+	mp.mutex.Lock()
+	mp.lastUsed = time.Now()
+	mp.Alive = false
+	mp.Exit = exit
+	mp.mutex.Unlock()
+	mp.persist()
+
+	// The process doesn't write logs any more, so they are read
+	// from the disk and the recent logs kept in memory are released
+	mp.mutex.RLock()
+	logs := mp.logs
+	mp.mutex.RUnlock()
+	if logs != nil {
+		logs.Close()
+
+		// The process may be already discarded, then its logs are not available anymore
+		mp.mutex.Lock()
+		if mp.logs != nil {
+			mp.logs = unbuffered(logs)
+		}
+		mp.mutex.Unlock()
+	}
+
+	body := mp.newStatusEventBody()
+	body.Exit = exit
 	mp.notifySubs(op.NewEventNow(ProcessDiedEventType, body), ProcessStatusBit)
 
 	mp.mutex.Lock()
@@ -375,6 +1138,43 @@ func (mp *MachineProcess) notifySubs(event *op.Event, typeBit uint64) {
 	}
 }
 
+func (mp *MachineProcess) newStatusEventBody() *ProcessStatusEventBody {
+	return &ProcessStatusEventBody{
+		ProcessEventBody: ProcessEventBody{Pid: mp.Pid},
+		NativePid:        mp.NativePid,
+		Name:             mp.Name,
+		CommandLine:      mp.CommandLine,
+		StartTime:        mp.StartTime,
+	}
+}
+
+// Creates exit information from the state of the waited process,
+// if the state is not available only the timing information is set
+func newExitInfo(state *os.ProcessState, start time.Time, end time.Time) *ExitInfo {
+	exit := &ExitInfo{
+		ExitCode: -1,
+		EndTime:  end,
+		Duration: int64(end.Sub(start) / time.Millisecond),
+	}
+	if state == nil {
+		return exit
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok {
+		exit.ExitCode = status.ExitStatus()
+		if status.Signaled() {
+			exit.Signal = signalName(status.Signal())
+		}
+	}
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		exit.Usage = ResourceUsage{
+			UserTime:   int64(time.Duration(rusage.Utime.Nano()) / time.Millisecond),
+			SystemTime: int64(time.Duration(rusage.Stime.Nano()) / time.Millisecond),
+			MaxRss:     int64(rusage.Maxrss),
+		}
+	}
+	return exit
+}
+
 // Writes to a channel and returns true if write is successful,
 // otherwise if write to the channel failed e.g. channel is closed then returns false
 func tryWrite(eventsChan chan *op.Event, event *op.Event) (ok bool) {
@@ -387,10 +1187,40 @@ func tryWrite(eventsChan chan *op.Event, event *op.Event) (ok bool) {
 	return true
 }
 
-func newOutputEvent(pid uint64, kind string, line string, time time.Time) *op.Event {
+func newOutputEvent(pid uint64, message *LogMessage) *op.Event {
 	body := &ProcessOutputEventBody{
 		ProcessEventBody: ProcessEventBody{Pid: pid},
-		Text:             line,
+		Text:             message.Text,
+		Encoding:         message.Encoding,
+		Seq:              message.Seq,
+	}
+	eventType := StdoutEventType
+	if message.Kind == StderrKind {
+		eventType = StderrEventType
+	}
+	return op.NewEvent(eventType, body, message.Time)
+}
+
+// Creates the log message of the output line, if the line
+// is not valid UTF-8 then its text is base64 encoded
+func newLogMessage(kind string, time time.Time, line string) *LogMessage {
+	if utf8.ValidString(line) {
+		return &LogMessage{Kind: kind, Time: time, Text: line}
+	}
+	return &LogMessage{
+		Kind:     kind,
+		Time:     time,
+		Text:     base64.StdEncoding.EncodeToString([]byte(line)),
+		Encoding: Base64Encoding,
+	}
+}
+
+// Returns the output line which this message is created from
+func (message *LogMessage) Line() string {
+	if message.Encoding == Base64Encoding {
+		if data, err := base64.StdEncoding.DecodeString(message.Text); err == nil {
+			return string(data)
+		}
 	}
-	return op.NewEvent(kind, body, time)
+	return message.Text
 }
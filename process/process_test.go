@@ -1,11 +1,22 @@
 package process_test
 
 import (
+	"flag"
+	"fmt"
 	"github.com/evoevodin/machine-agent/op"
 	"github.com/evoevodin/machine-agent/process"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
-	"os"
 )
 
 func TestMachineProcessIsNotAliveAfterItIsDead(t *testing.T) {
@@ -43,17 +54,871 @@ func TestReadProcessLogs(t *testing.T) {
 	}
 }
 
-func startAndWaitTestProcess(t *testing.T) *process.MachineProcess {
+func TestProcessExitInfoIsSetWhenProcessIsDead(t *testing.T) {
+	p := startAndWaitProcess(t, "sleep 0.1; exit 3")
+	defer os.RemoveAll(process.LogsDir)
+	if p.Exit == nil {
+		t.Fatal("Expected exit info to be set")
+	}
+	if p.Exit.ExitCode != 3 {
+		t.Fatalf("Expected exit code to be 3, but got %d", p.Exit.ExitCode)
+	}
+	if p.Exit.Signal != "" {
+		t.Fatalf("Expected no signal, but got '%s'", p.Exit.Signal)
+	}
+	if p.Exit.Duration < 100 {
+		t.Fatalf("Expected duration to be >= 100ms, but got %d", p.Exit.Duration)
+	}
+}
+
+func TestProcessEnvAndWorkingDir(t *testing.T) {
+	p := startAndWaitCommand(t, process.Command{
+		Name:        "test",
+		CommandLine: "echo \"$TEST_VAR\"; pwd",
+		Type:        "test",
+		Env:         map[string]string{"TEST_VAR": "test value"},
+		WorkingDir:  os.TempDir(),
+	})
+	defer os.RemoveAll(process.LogsDir)
+	checkLogs(t, p, []string{"test value", os.TempDir()})
+}
+
+func TestProcessStartedWithArgvIsNotInterpretedByShell(t *testing.T) {
+	p := startAndWaitCommand(t, process.Command{
+		Name: "test",
+		Type: "test",
+		Argv: []string{"echo", "$HOME", "'a  b'"},
+	})
+	defer os.RemoveAll(process.LogsDir)
+	checkLogs(t, p, []string{"$HOME 'a  b'"})
+}
+
+func TestWriteProcessInput(t *testing.T) {
+	command := process.Command{
+		Name:        "test",
+		CommandLine: "read line; echo \"got $line\"; cat",
+		Type:        "test",
+	}
+	p := startAndWait(t, command, func(p *process.MachineProcess) {
+		if err := p.WriteInput([]byte("line1\nline2\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.CloseInput(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer os.RemoveAll(process.LogsDir)
+	checkLogs(t, p, []string{"got line1", "line2"})
+}
+
+func TestProcessWhichFailedToStartDoesNotTakePid(t *testing.T) {
+	first := startAndWaitTestProcess(t)
+	defer os.RemoveAll(process.LogsDir)
+
+	failed := process.NewProcess(process.Command{
+		Name: "test",
+		Type: "test",
+		Argv: []string{"/non/existing/program"},
+	})
+	if err := failed.Start(); err == nil {
+		t.Fatal("Expected process not to be started")
+	}
+
+	second := startAndWaitTestProcess(t)
+	defer os.RemoveAll(process.LogsDir)
+	if second.Pid != first.Pid+1 {
+		t.Fatalf("Expected pid %d to follow pid %d, but got %d", first.Pid+1, first.Pid, second.Pid)
+	}
+}
+
+func TestWriteInputAfterInputIsClosedFails(t *testing.T) {
+	command := process.Command{
+		Name:        "test",
+		CommandLine: "cat; sleep 0.2",
+		Type:        "test",
+	}
+	startAndWait(t, command, func(p *process.MachineProcess) {
+		if err := p.CloseInput(); err != nil {
+			t.Fatal(err)
+		}
+		err := p.WriteInput([]byte("input"))
+		if _, ok := err.(*process.InputClosedError); !ok {
+			t.Fatalf("Expected InputClosedError, but got '%v'", err)
+		}
+	})
+	defer os.RemoveAll(process.LogsDir)
+}
+
+func TestWriteInputToDeadProcessFails(t *testing.T) {
+	p := startAndWaitTestProcess(t)
+	defer os.RemoveAll(process.LogsDir)
+	err := p.WriteInput([]byte("input"))
+	if _, ok := err.(*process.NotAliveError); !ok {
+		t.Fatalf("Expected NotAliveError, but got '%v'", err)
+	}
+}
+
+func TestKillIsEscalatedAfterGracePeriod(t *testing.T) {
+	command := process.Command{
+		Name:        "test",
+		CommandLine: "trap '' TERM; echo started; sleep 5",
+		Type:        "test",
+	}
+	p := startAndWait(t, command, func(p *process.MachineProcess) {
+		// Give the shell time to set up the trap
+		time.Sleep(200 * time.Millisecond)
+		if err := p.KillWithSignal(syscall.SIGTERM, 100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer os.RemoveAll(process.LogsDir)
+	if p.Exit.KillSignal != "SIGTERM" {
+		t.Fatalf("Expected kill signal to be SIGTERM, but got '%s'", p.Exit.KillSignal)
+	}
+	if p.Exit.Signal != "SIGKILL" {
+		t.Fatalf("Expected process to be terminated by SIGKILL, but got '%s'", p.Exit.Signal)
+	}
+}
+
+func TestSuspendAndResumeProcess(t *testing.T) {
+	command := process.Command{
+		Name:        "test",
+		CommandLine: "sleep 5",
+		Type:        "test",
+	}
+	p := startAndWait(t, command, func(p *process.MachineProcess) {
+		if err := p.Suspend(); err != nil {
+			t.Fatal(err)
+		}
+		if !p.Paused {
+			t.Fatal("Expected process to be paused")
+		}
+		if err := p.Resume(); err != nil {
+			t.Fatal(err)
+		}
+		if p.Paused {
+			t.Fatal("Expected process to be resumed")
+		}
+		if err := p.Kill(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer os.RemoveAll(process.LogsDir)
+	if err := p.Suspend(); err == nil {
+		t.Fatal("Expected dead process can't be suspended")
+	}
+}
+
+func TestPausedProcessIsResumedWhenItIsSignaled(t *testing.T) {
+	events := make(chan *op.Event, 10)
+	command := process.Command{
+		Name:        "test",
+		CommandLine: "sleep 5",
+		Type:        "test",
+	}
+	startAndWait(t, command, func(p *process.MachineProcess) {
+		p.AddSubscriber(&process.Subscriber{
+			Id:      "resumed",
+			Mask:    process.DefaultMask,
+			Channel: events,
+		})
+		if err := p.Suspend(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.KillWithSignal(syscall.SIGTERM, 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer os.RemoveAll(process.LogsDir)
+	for {
+		select {
+		case event := <-events:
+			if event.EventType == process.ProcessResumedEventType {
+				return
+			}
+		default:
+			t.Fatalf("Expected %s event to be published", process.ProcessResumedEventType)
+		}
+	}
+}
+
+func TestProcessIsTerminatedWhenTimeoutIsReached(t *testing.T) {
+	p := startAndWaitCommand(t, process.Command{
+		Name:        "test",
+		CommandLine: "sleep 5",
+		Type:        "test",
+		Timeout:     1,
+	})
+	defer os.RemoveAll(process.LogsDir)
+	if !p.TimedOut || !p.Exit.TimedOut {
+		t.Fatal("Expected process to be timed out")
+	}
+	if p.Exit.KillSignal != "SIGTERM" {
+		t.Fatalf("Expected kill signal to be SIGTERM, but got '%s'", p.Exit.KillSignal)
+	}
+}
+
+func TestProcessIsLimitedWithRlimits(t *testing.T) {
+	coreSize := uint64(0)
+	p := startAndWaitCommand(t, process.Command{
+		Name:        "test",
+		CommandLine: "ulimit -n; ulimit -c",
+		Type:        "test",
+		Limits: &process.ResourceLimits{
+			OpenFiles: 64,
+			CoreSize:  &coreSize,
+		},
+	})
+	defer os.RemoveAll(process.LogsDir)
+	checkLogs(t, p, []string{"64", "0"})
+}
+
+func TestProcessPidsLimitIsReportedInExitInfo(t *testing.T) {
+	p := startLimitedAndWait(t, "for i in 1 2 3 4; do sleep 1 & done; wait", &process.ResourceLimits{Pids: 2})
+	defer os.RemoveAll(process.LogsDir)
+	if p.Exit == nil || !p.Exit.PidsLimited {
+		t.Fatalf("Expected the pids limit to be reached, but got %v", p.Exit)
+	}
+}
+
+func TestProcessesLeftInCgroupAreKilled(t *testing.T) {
+	p := startLimitedAndWait(t, "sleep 30 > /dev/null 2>&1 & echo $!", &process.ResourceLimits{Pids: 10})
+	defer os.RemoveAll(process.LogsDir)
+
+	logs, err := p.ReadLogs(time.Time{}, time.Now())
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("Expected the pid of the child process, but got %v", logs)
+	}
+	child, err := strconv.Atoi(logs[0].Text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for syscall.Kill(child, 0) == nil {
+		if time.Now().After(deadline) {
+			syscall.Kill(child, syscall.SIGKILL)
+			t.Fatal("Expected the child process left in the cgroup to be killed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemoryLimitRequiresCgroup(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		t.Skip("Cgroup v2 is available")
+	}
+	server := httptest.NewServer(newProcessRouter())
+	defer server.Close()
+
+	body := `{"name": "test", "commandLine": "true", "type": "test", "limits": {"memory": 1048576}}`
+	resp, err := http.Post(server.URL+"/process", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, but got %d", resp.StatusCode)
+	}
+}
+
+func TestCommandLineCanNotBeUsedWithArgv(t *testing.T) {
+	server := httptest.NewServer(newProcessRouter())
+	defer server.Close()
+
+	body := `{"name": "test", "commandLine": "echo shown", "argv": ["echo", "executed"], "type": "test"}`
+	resp, err := http.Post(server.URL+"/process", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, but got %d", resp.StatusCode)
+	}
+}
+
+func TestTooSmallLogsSegmentIsRejected(t *testing.T) {
+	server := httptest.NewServer(newProcessRouter())
+	defer server.Close()
+
+	body := `{"name": "test", "commandLine": "true", "type": "test", "logs": {"segmentSize": 1024}}`
+	resp, err := http.Post(server.URL+"/process", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, but got %d", resp.StatusCode)
+	}
+}
+
+func TestProcessStats(t *testing.T) {
+	command := process.Command{
+		Name:        "test",
+		CommandLine: "sleep 5 & setsid sleep 3 > /dev/null 2>&1 & sleep 5",
+		Type:        "test",
+	}
+	p := startAndWait(t, command, func(p *process.MachineProcess) {
+		time.Sleep(100 * time.Millisecond)
+		stats, err := p.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The process which left the group is still the descendant of the process
+		if stats.Processes != 4 {
+			t.Fatalf("Expected process group and its descendants to contain 4 processes, but got %d", stats.Processes)
+		}
+		if stats.Rss <= 0 || stats.Threads < 3 {
+			t.Fatalf("Expected rss and threads to be collected, but got %v", stats)
+		}
+		p.Kill()
+	})
+	defer os.RemoveAll(process.LogsDir)
+	if _, err := p.Stats(); err == nil {
+		t.Fatal("Expected stats of dead process can't be collected")
+	}
+}
+
+func TestProcessTree(t *testing.T) {
+	command := process.Command{
+		Name:        "test",
+		CommandLine: "sleep 5 & sleep 5; echo done",
+		Type:        "test",
+	}
+	startAndWait(t, command, func(p *process.MachineProcess) {
+		time.Sleep(100 * time.Millisecond)
+		tree, err := p.Tree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tree.NativePid != p.NativePid {
+			t.Fatalf("Expected tree root to be %d, but got %d", p.NativePid, tree.NativePid)
+		}
+		if len(tree.Children) != 2 {
+			t.Fatalf("Expected root to have 2 children, but got %d", len(tree.Children))
+		}
+		for _, child := range tree.Children {
+			if len(child.Argv) != 2 || child.Argv[0] != "sleep" {
+				t.Fatalf("Expected child to be 'sleep 5', but got %v", child.Argv)
+			}
+		}
+		p.Kill()
+	})
+	defer os.RemoveAll(process.LogsDir)
+}
+
+func TestProcessIsRestartedOnFailure(t *testing.T) {
+	p := startAndWaitCommand(t, process.Command{
+		Name:        "test",
+		CommandLine: "echo run; exit 1",
+		Type:        "test",
+		Restart: &process.RestartPolicy{
+			Policy:     process.OnFailureRestartPolicy,
+			MaxRetries: 1,
+		},
+	})
+	defer os.RemoveAll(process.LogsDir)
+	if p.Restarts != 1 {
+		t.Fatalf("Expected process to be restarted once, but it was restarted %d times", p.Restarts)
+	}
+	if p.Exit == nil || p.Exit.ExitCode != 1 {
+		t.Fatalf("Expected exit code of the last run to be 1, but got %v", p.Exit)
+	}
+
+	// Logs of all the runs are written to the same file
+	checkLogs(t, p, []string{"run", "run"})
+}
+
+func TestProcessIsRestartedAfterSignalWhichDoesNotKillIt(t *testing.T) {
+	p := startAndWait(t, process.Command{
+		Name:        "test",
+		CommandLine: "trap 'echo hup' HUP; sleep 0.3; exit 1",
+		Type:        "test",
+		Restart: &process.RestartPolicy{
+			Policy:     process.OnFailureRestartPolicy,
+			MaxRetries: 1,
+		},
+	}, func(p *process.MachineProcess) {
+		// Give the shell time to set up the trap
+		time.Sleep(100 * time.Millisecond)
+		if err := p.KillWithSignal(syscall.SIGHUP, 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer os.RemoveAll(process.LogsDir)
+	if p.Restarts != 1 {
+		t.Fatalf("Expected process to be restarted once, but it was restarted %d times", p.Restarts)
+	}
+	if p.Exit == nil || p.Exit.KillSignal != "" {
+		t.Fatalf("Expected the last run not to be killed, but got %v", p.Exit)
+	}
+}
+
+func TestStatsOfRestartingProcessAreNotAvailable(t *testing.T) {
+	startAndWait(t, process.Command{
+		Name:        "test",
+		CommandLine: "exit 1",
+		Type:        "test",
+		Restart: &process.RestartPolicy{
+			Policy:     process.OnFailureRestartPolicy,
+			MaxRetries: 1,
+		},
+	}, func(p *process.MachineProcess) {
+		// The process is waiting for the restart during the backoff of 1 second
+		deadline := time.Now().Add(time.Second)
+		for {
+			_, err := p.Stats()
+			if _, ok := err.(*process.RestartingError); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the restarting error, but got %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	defer os.RemoveAll(process.LogsDir)
+}
+
+func TestProcessIsReadyWhenLogMatchesPattern(t *testing.T) {
+	p := startAndWaitCommand(t, process.Command{
+		Name:        "test",
+		CommandLine: "echo starting; sleep 0.2; echo server is listening on 8080; sleep 0.2",
+		Type:        "test",
+		Readiness:   &process.ReadinessProbe{LogPattern: "listening on \\d+"},
+	})
+	defer os.RemoveAll(process.LogsDir)
+	if !p.Ready {
+		t.Fatal("Expected process to be ready")
+	}
+}
+
+func TestProcessIsReadyWhenPortAcceptsConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	p := startAndWaitCommand(t, process.Command{
+		Name:        "test",
+		CommandLine: "sleep 0.5",
+		Type:        "test",
+		Readiness:   &process.ReadinessProbe{Port: listener.Addr().(*net.TCPAddr).Port},
+	})
+	defer os.RemoveAll(process.LogsDir)
+	if !p.Ready {
+		t.Fatal("Expected process to be ready")
+	}
+}
+
+func TestProcessesAreLoadedFromRegistry(t *testing.T) {
+	p := startAndWaitProcess(t, "echo hello; exit 2")
+	defer os.RemoveAll(process.LogsDir)
+
+	record := filepath.Join(process.LogsDir, "state", "processes", fmt.Sprintf("pid-%d.json", p.Pid))
+	if info, err := os.Stat(record); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected process record '%s' to be readable only by the owner, but got %v, %v", record, info, err)
+	}
+	if err := process.LoadProcesses(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, ok := process.Get(p.Pid)
+	if !ok {
+		t.Fatal("Expected process to be loaded")
+	}
+	if loaded == p {
+		t.Fatal("Expected process to be replaced with the loaded one")
+	}
+	if loaded.Alive || loaded.Exit == nil || loaded.Exit.ExitCode != 2 {
+		t.Fatalf("Expected loaded process to be dead with exit code 2, but got %v", loaded.Exit)
+	}
+	checkLogs(t, loaded, []string{"hello"})
+}
+
+func TestAliveProcessIsReadoptedWhenRegistryIsLoaded(t *testing.T) {
 	process.LogsDir = os.TempDir() + string(os.PathSeparator) + randomName(10)
+	defer os.RemoveAll(process.LogsDir)
+	p := process.NewProcess(process.Command{
+		Name:        "test",
+		CommandLine: "sleep 5",
+		Type:        "test",
+	})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := process.LoadProcesses(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := process.Get(p.Pid)
+	if loaded == p || !loaded.Alive || loaded.Lost {
+		t.Fatal("Expected process to be re-adopted")
+	}
+
 	events := make(chan *op.Event)
-	done := make(chan bool)
+	loaded.AddSubscriber(&process.Subscriber{
+		Id:      "test",
+		Mask:    process.DefaultMask,
+		Channel: events,
+	})
+	if err := loaded.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.EventType != process.ProcessDiedEventType {
+			t.Fatalf("Expected %s event, but got %s", process.ProcessDiedEventType, event.EventType)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected re-adopted process to be dead after it is killed")
+	}
+	if loaded.Exit == nil || loaded.Exit.KillSignal != "SIGKILL" {
+		t.Fatalf("Expected re-adopted process to be killed with SIGKILL, but got %v", loaded.Exit)
+	}
+}
 
-	// Create and start process
-	p := process.NewProcess(process.Command{
+func TestAdoptedProcessDiesWhenItIsKilled(t *testing.T) {
+	process.LogsDir = os.TempDir() + string(os.PathSeparator) + randomName(10)
+	defer os.RemoveAll(process.LogsDir)
+	cmd := exec.Command("sleep", "5")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go cmd.Wait()
+
+	events := make(chan *op.Event)
+	p, err := process.AdoptProcess(cmd.Process.Pid, "", "test", &process.Subscriber{
+		Id:      "test",
+		Mask:    process.DefaultMask,
+		Channel: events,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "sleep" || p.CommandLine != "sleep 5" {
+		t.Fatalf("Expected adopted process to be 'sleep 5', but got '%s' '%s'", p.Name, p.CommandLine)
+	}
+	if _, err := process.AdoptProcess(cmd.Process.Pid, "", "test", nil); err == nil {
+		t.Fatal("Expected the adopted process not to be adopted again")
+	} else if _, ok := err.(*process.AdoptedError); !ok {
+		t.Fatalf("Expected AdoptedError, but got '%s'", err.Error())
+	}
+	if _, err := p.Stats(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.EventType != process.ProcessDiedEventType {
+			t.Fatalf("Expected %s event, but got %s", process.ProcessDiedEventType, event.EventType)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected adopted process to be dead after it is killed")
+	}
+}
+
+func TestInitProcessIsNotAdopted(t *testing.T) {
+	_, err := process.AdoptProcess(1, "", "test", nil)
+	if _, ok := err.(*process.BadAdoptionError); !ok {
+		t.Fatalf("Expected BadAdoptionError, but got %v", err)
+	}
+}
+
+func TestProcessIsRunAsAnotherUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Running processes as another user requires root")
+	}
+	p := startAndWaitCommand(t, process.Command{
+		Name:        "test",
+		CommandLine: "id -un; id -g; echo $USER",
+		Type:        "test",
+		User:        "nobody",
+		Group:       "0",
+	})
+	defer os.RemoveAll(process.LogsDir)
+	checkLogs(t, p, []string{"nobody", "0", "nobody"})
+}
+
+func TestProcessIsNotStartedWithGroupWhichIsNotAllowed(t *testing.T) {
+	server := httptest.NewServer(newProcessRouter())
+	defer server.Close()
+
+	body := `{"name": "test", "commandLine": "id -g", "type": "test", "user": "nobody", "group": "0"}`
+	resp, err := http.Post(server.URL+"/process", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, but got %d", resp.StatusCode)
+	}
+}
+
+func TestProcessIsRunInTerminal(t *testing.T) {
+	p := startAndWaitCommand(t, process.Command{
+		Name:        "test",
+		CommandLine: "test -t 1 && echo terminal; stty size; echo error >&2",
+		Type:        "test",
+		Tty:         true,
+	})
+	defer os.RemoveAll(process.LogsDir)
+	checkLogs(t, p, []string{"terminal", "24 80", "error"})
+}
+
+func TestNotUtf8OutputIsBase64Encoded(t *testing.T) {
+	p := startAndWaitProcess(t, "printf 'text\\n\\377\\376'")
+	defer os.RemoveAll(process.LogsDir)
+	logs, err := p.ReadLogs(time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("Expected 2 log messages, but got %d", len(logs))
+	}
+	if logs[0].Encoding != "" || logs[0].Text != "text" {
+		t.Fatalf("Expected the first message to be plain 'text', but got '%s' '%s'", logs[0].Encoding, logs[0].Text)
+	}
+	if logs[1].Encoding != process.Base64Encoding || logs[1].Line() != "\xff\xfe" {
+		t.Fatalf("Expected the second message to be base64 encoded, but got '%s' '%s'", logs[1].Encoding, logs[1].Text)
+	}
+}
+
+func TestSubscriberIsRestoredAfterSequenceNumber(t *testing.T) {
+	p := startAndWaitProcess(t, "printf 'a\\nb\\nc\\n'")
+	defer os.RemoveAll(process.LogsDir)
+	logs, err := p.ReadLogs(time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, message := range logs {
+		if message.Seq != uint64(idx+1) {
+			t.Fatalf("Expected message '%s' to have sequence number %d, but got %d", message.Text, idx+1, message.Seq)
+		}
+	}
+
+	events := make(chan *op.Event, 10)
+	subscriber := &process.Subscriber{Id: "restored", Mask: process.DefaultMask, Channel: events}
+	if err := p.RestoreSubscriberAfterSeq(subscriber, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"b", "c"} {
+		body := (<-events).Body.(*process.ProcessOutputEventBody)
+		if body.Text != expected {
+			t.Fatalf("Expected restored line '%s', but got '%s'", expected, body.Text)
+		}
+	}
+	if len(events) != 0 {
+		t.Fatalf("Expected only the lines after sequence number 1 to be restored, but got %d more", len(events))
+	}
+}
+
+func TestSearchProcessLogs(t *testing.T) {
+	p := startAndWaitCommand(t, process.Command{
+		Name:        randomName(10),
+		CommandLine: "printf 'compiling\\nBUILD FAILURE\\ndone\\n'",
+		Type:        "test",
+	})
+	defer os.RemoveAll(process.LogsDir)
+
+	matches, err := p.SearchLogs(&process.LogsQuery{
+		Text:       "build failure",
+		IgnoreCase: true,
+		Mask:       process.DefaultMask,
+		Till:       time.Now(),
+		Context:    1,
+		Limit:      10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Text != "BUILD FAILURE" || matches[0].Seq != 2 {
+		t.Fatalf("Expected to find the 'BUILD FAILURE' line, but got %d matches", len(matches))
+	}
+	if len(matches[0].Before) != 1 || matches[0].Before[0].Text != "compiling" {
+		t.Fatal("Expected the 'compiling' line before the match")
+	}
+	if len(matches[0].After) != 1 || matches[0].After[0].Text != "done" {
+		t.Fatal("Expected the 'done' line after the match")
+	}
+
+	matches, err = process.SearchProcessesLogs(p.Name, p.Type, &process.LogsQuery{
+		Text:   "^(compiling|done)$",
+		Regexp: true,
+		Mask:   process.DefaultMask,
+		Till:   time.Now(),
+		Limit:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].Pid != p.Pid || matches[1].Text != "done" {
+		t.Fatalf("Expected to find 2 lines of process '%d' by regexp, but got %d matches", p.Pid, len(matches))
+	}
+}
+
+func TestDeadProcessesAreCleanedUpOldestFirst(t *testing.T) {
+	kept := startAndWaitCommand(t, process.Command{
+		Name:        "test",
+		CommandLine: "echo kept",
+		Type:        "test",
+		Keep:        true,
+	})
+	oldest := startAndWaitProcess(t, "echo oldest")
+	latest := startAndWaitProcess(t, "echo latest")
+	defer os.RemoveAll(process.LogsDir)
+
+	flag.Set("process-lifetime", "-1")
+	flag.Set("process-max-dead", "1")
+	defer func() {
+		flag.Set("process-lifetime", "60")
+		flag.Set("process-max-dead", "0")
+	}()
+	report := process.NewCleaner().Cleanup()
+
+	if _, ok := process.Get(oldest.Pid); ok {
+		t.Fatalf("Expected the oldest dead process '%d' to be removed", oldest.Pid)
+	}
+	if _, err := oldest.ReadLogs(time.Time{}, time.Now()); !os.IsNotExist(err) {
+		t.Fatalf("Expected the logs of the process '%d' to be removed", oldest.Pid)
+	}
+	if _, ok := process.Get(latest.Pid); !ok {
+		t.Fatalf("Expected the latest dead process '%d' to be kept", latest.Pid)
+	}
+	if _, ok := process.Get(kept.Pid); !ok {
+		t.Fatalf("Expected the kept process '%d' not to be removed", kept.Pid)
+	}
+	removed := false
+	for _, pid := range report.Removed {
+		removed = removed || pid == oldest.Pid
+	}
+	if !removed || report.Freed == 0 {
+		t.Fatalf("Expected the cleanup report to include the process '%d' and its logs", oldest.Pid)
+	}
+
+	// Kept process is removed only explicitly
+	if _, err := kept.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := process.Get(kept.Pid); ok {
+		t.Fatalf("Expected the discarded process '%d' to be removed", kept.Pid)
+	}
+}
+
+func TestDeadProcessIsDiscardedOnlyWhenRequested(t *testing.T) {
+	p := startAndWaitTestProcess(t)
+	defer os.RemoveAll(process.LogsDir)
+
+	server := httptest.NewServer(newProcessRouter())
+	defer server.Close()
+
+	for _, query := range []string{"", "?discard=true"} {
+		req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/process/%d%s", server.URL, p.Pid, query), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		_, exists := process.Get(p.Pid)
+		if query == "" && (resp.StatusCode != http.StatusConflict || !exists) {
+			t.Fatalf("Expected the dead process to be kept with status 409, but got %d", resp.StatusCode)
+		}
+		if query != "" && (resp.StatusCode != http.StatusOK || exists) {
+			t.Fatalf("Expected the dead process to be discarded with status 200, but got %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestSecretsAreMaskedInProcessOutput(t *testing.T) {
+	p := startAndWaitCommand(t, process.Command{
+		Name: "test",
+		CommandLine: "echo \"token $API_TOKEN\"; echo 'pass hunter2'; echo 'password=abc123 ok'; echo 'key-42';" +
+			"printf 'partial hun'; sleep 1; echo 'ter2'",
+		Type: "test",
+		Env:  map[string]string{"API_TOKEN": "s3cr3t-t0ken"},
+		Secrets: &process.Secrets{
+			Values:   []string{"hunter2"},
+			Patterns: []string{`password=(\S+)|key-\d+`},
+			Env:      []string{"API_TOKEN"},
+		},
+	})
+	defer os.RemoveAll(process.LogsDir)
+
+	// The partial line is published without the beginning of the secret
+	checkLogs(t, p, []string{"token ****", "pass ****", "password=**** ok", "****", "partial ", "****"})
+	if p.Redactions != 5 {
+		t.Fatalf("Expected 5 redactions, but got %d", p.Redactions)
+	}
+
+	record, err := ioutil.ReadFile(filepath.Join(process.LogsDir, "state", "processes", fmt.Sprintf("pid-%d.json", p.Pid)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(record), `"values"`) || strings.Contains(string(record), "s3cr3t-t0ken") {
+		t.Fatalf("Expected the persisted process to contain no secrets, but got %s", record)
+	}
+}
+
+// Starts the process with the cgroup limits and waits until it is dead,
+// the test is skipped if the agent can't create cgroups with pids controller
+func startLimitedAndWait(t *testing.T, commandLine string, limits *process.ResourceLimits) *process.MachineProcess {
+	controllers, err := ioutil.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+	if err != nil || os.Geteuid() != 0 || !strings.Contains(string(controllers), "pids") {
+		t.Skip("Cgroup v2 with pids controller is not available")
+	}
+	return startAndWaitCommand(t, process.Command{
 		Name:        "test",
-		CommandLine: "printf \"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\"",
+		CommandLine: commandLine,
 		Type:        "test",
+		Limits:      limits,
 	})
+}
+
+func checkLogs(t *testing.T, p *process.MachineProcess, expected []string) {
+	logs, err := p.ReadLogs(time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != len(expected) {
+		t.Fatalf("Expected %d log messages, but got %d", len(expected), len(logs))
+	}
+	for idx := range logs {
+		if expected[idx] != logs[idx].Text {
+			t.Fatalf("Expected log message to be '%s', but got '%s'", expected[idx], logs[idx].Text)
+		}
+	}
+}
+
+func startAndWaitTestProcess(t *testing.T) *process.MachineProcess {
+	return startAndWaitProcess(t, "printf \"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\"")
+}
+
+func startAndWaitProcess(t *testing.T, commandLine string) *process.MachineProcess {
+	return startAndWaitCommand(t, process.Command{
+		Name:        "test",
+		CommandLine: commandLine,
+		Type:        "test",
+	})
+}
+
+func startAndWaitCommand(t *testing.T, command process.Command) *process.MachineProcess {
+	return startAndWait(t, command, nil)
+}
+
+// Starts the process and waits until it is dead, the afterStart
+// function is called right after the process is started if it is not nil
+func startAndWait(t *testing.T, command process.Command, afterStart func(p *process.MachineProcess)) *process.MachineProcess {
+	process.LogsDir = os.TempDir() + string(os.PathSeparator) + randomName(10)
+	events := make(chan *op.Event)
+	done := make(chan bool)
+
+	// Create and start process
+	p := process.NewProcess(command)
 
 	p.AddSubscriber(&process.Subscriber{
 		Id:      "test",
@@ -79,6 +944,9 @@ func startAndWaitTestProcess(t *testing.T) *process.MachineProcess {
 	if err := p.Start(); err != nil {
 		t.Fatal(err)
 	}
+	if afterStart != nil {
+		afterStart(p)
+	}
 
 	// Wait until process is finished or timeout is reached
 	if ok := <-done; !ok {
@@ -0,0 +1,220 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	procDir = "/proc"
+
+	// The number of clock ticks per second used in /proc,
+	// it is 100 on all the architectures supported by linux
+	clockTicks = 100
+)
+
+// Describes a native process as it is seen in /proc/{pid}/stat
+type procStat struct {
+	Pid  int
+	Comm string
+
+	// The process state e.g. 'R' running, 'S' sleeping, 'T' stopped
+	State string
+	Ppid  int
+	Pgrp  int
+
+	// CPU time spent in user and kernel mode(in clock ticks)
+	Utime uint64
+	Stime uint64
+
+	NumThreads int
+
+	// The time the process started after system boot(in clock ticks)
+	StartTime uint64
+
+	// Resident set size(in pages)
+	Rss int64
+}
+
+// Reads the stat of the native process with the given pid
+func readProcStat(pid int) (*procStat, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/stat", procDir, pid))
+	if err != nil {
+		return nil, err
+	}
+	return parseProcStat(string(content))
+}
+
+// Parses the content of /proc/{pid}/stat, the process name is
+// in parenthesis and may contain spaces, so it is parsed separately
+func parseProcStat(content string) (*procStat, error) {
+	nameStart := strings.IndexByte(content, '(')
+	nameEnd := strings.LastIndexByte(content, ')')
+	if nameStart < 0 || nameEnd < nameStart {
+		return nil, errors.New("Unexpected format of process stat")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(content[:nameStart]))
+	if err != nil {
+		return nil, err
+	}
+
+	// fields after the process name, the first one is the state which is the 3rd stat field
+	fields := strings.Fields(content[nameEnd+1:])
+	if len(fields) < 22 {
+		return nil, errors.New("Unexpected format of process stat")
+	}
+	stat := &procStat{
+		Pid:   pid,
+		Comm:  content[nameStart+1 : nameEnd],
+		State: fields[0],
+	}
+	stat.Ppid, _ = strconv.Atoi(fields[1])
+	stat.Pgrp, _ = strconv.Atoi(fields[2])
+	stat.Utime, _ = strconv.ParseUint(fields[11], 10, 64)
+	stat.Stime, _ = strconv.ParseUint(fields[12], 10, 64)
+	stat.NumThreads, _ = strconv.Atoi(fields[17])
+	stat.StartTime, _ = strconv.ParseUint(fields[19], 10, 64)
+	stat.Rss, _ = strconv.ParseInt(fields[21], 10, 64)
+	return stat, nil
+}
+
+// Reads stats of all the native processes, the processes
+// which finished while reading are skipped
+func readAllProcStats() ([]*procStat, error) {
+	names, err := readDirNames(procDir)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]*procStat, 0, len(names))
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		if stat, err := readProcStat(pid); err == nil {
+			stats = append(stats, stat)
+		}
+	}
+	return stats, nil
+}
+
+// Reads stats of the native process with the given pid, the processes of the given
+// process group if it is not 0, the given members and all their descendants.
+// The descendants are found by their parents, so the descendants which left the group
+// e.g. with setsid are included, but the orphans adopted by init are included only if they are members
+func readFamilyProcStats(pid int, pgid int, members []int) ([]*procStat, error) {
+	all, err := readAllProcStats()
+	if err != nil {
+		return nil, err
+	}
+	included := map[int]bool{pid: true}
+	for _, member := range members {
+		included[member] = true
+	}
+	children := make(map[int][]*procStat)
+	queue := []*procStat{}
+	for _, stat := range all {
+		children[stat.Ppid] = append(children[stat.Ppid], stat)
+		if included[stat.Pid] || (pgid != 0 && stat.Pgrp == pgid) {
+			included[stat.Pid] = true
+			queue = append(queue, stat)
+		}
+	}
+	family := []*procStat{}
+	for len(queue) != 0 {
+		stat := queue[0]
+		queue = queue[1:]
+		family = append(family, stat)
+		for _, child := range children[stat.Pid] {
+			if !included[child.Pid] {
+				included[child.Pid] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return family, nil
+}
+
+// Returns the number of bytes read and written by the native process
+// from/to the storage layer, the values are taken from /proc/{pid}/io
+func readProcIO(pid int) (uint64, uint64, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/io", procDir, pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	var read, written uint64
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "read_bytes:":
+			read, _ = strconv.ParseUint(fields[1], 10, 64)
+		case "write_bytes:":
+			written, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return read, written, nil
+}
+
+// Returns the number of files opened by the native process
+func countProcFds(pid int) (int, error) {
+	names, err := readDirNames(fmt.Sprintf("%s/%d/fd", procDir, pid))
+	if err != nil {
+		return 0, err
+	}
+	return len(names), nil
+}
+
+// Returns the command line arguments of the native process,
+// the result is empty for zombies and kernel threads
+func readProcCmdline(pid int) ([]string, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/cmdline", procDir, pid))
+	if err != nil {
+		return nil, err
+	}
+	args := strings.Split(strings.TrimRight(string(content), "\x00"), "\x00")
+	if len(args) == 1 && args[0] == "" {
+		return []string{}, nil
+	}
+	return args, nil
+}
+
+// Returns the system boot time taken from the 'btime' line of /proc/stat
+func readBootTime() (time.Time, error) {
+	content, err := ioutil.ReadFile(procDir + "/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("Boot time is missing in " + procDir + "/stat")
+}
+
+// Converts the process start time in clock ticks after boot to the time
+func procStartTime(bootTime time.Time, ticks uint64) time.Time {
+	return bootTime.Add(time.Duration(ticks) * time.Second / clockTicks)
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
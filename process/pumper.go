@@ -3,16 +3,37 @@
 package process
 
 import (
-	"bufio"
+	"flag"
 	"io"
 	"log"
 	"sync"
 	"time"
+	"unicode/utf8"
+)
+
+const (
+	// The size of the buffer used for reading the output
+	pumpBufferSize = 4096
+
+	// How long the line which is not terminated yet is buffered,
+	// when the output is idle for this time the partial line is published
+	DefaultPartialLineTimeout = 500 * time.Millisecond
+)
+
+var (
+	maxLineSizeFlag int
+
+	// How long the partial line is buffered before it is published
+	PartialLineTimeout = DefaultPartialLineTimeout
 )
 
 type acceptLine func(line string)
 
-// LogsPumper client consumes a message read by pumper
+// Returns the position not greater than the given one which the partial line may be split at
+type splitLimit func(line string, position int) int
+
+// LogsPumper client consumes a message read by pumper.
+// Lines are passed as is, they are not guaranteed to be valid UTF-8
 type LogsConsumer interface {
 
 	// called on each line pumped from process stdout
@@ -25,18 +46,44 @@ type LogsConsumer interface {
 	Close()
 }
 
-// Pumps lines from the stdout and stderr
+// Pumps lines from the stdout and stderr.
+// Lines are terminated with '\n', '\r' or '\r\n'. The line which is not terminated
+// is published when the output is idle for PartialLineTimeout or the output is finished,
+// lines longer than the maximum line size are split into several lines
 type LogsPumper struct {
-	stdout    io.Reader
-	stderr    io.Reader
-	clients   []LogsConsumer
-	waitGroup sync.WaitGroup
+	stdout      io.Reader
+	stderr      io.Reader
+	clients     []LogsConsumer
+	waitGroup   sync.WaitGroup
+	maxLineSize int
+	limit       splitLimit
+}
+
+// Splits the output into lines
+type lineSplitter struct {
+	consume     acceptLine
+	maxLineSize int
+	limit       splitLimit
+	line        []byte
+
+	// Whether the last byte was '\r', so the following '\n' is not a new line
+	afterCR bool
+
+	// Whether the beginning of the current line was published by timeout,
+	// so the line terminator doesn't produce an empty line
+	partial bool
+}
+
+func init() {
+	flag.IntVar(&maxLineSizeFlag, "max-log-line-size", 16384,
+		`The maximum size of the process output line(in bytes), longer lines are split`)
 }
 
 func NewPumper(stdout io.Reader, stderr io.Reader) *LogsPumper {
 	return &LogsPumper{
-		stdout: stdout,
-		stderr: stderr,
+		stdout:      stdout,
+		stderr:      stderr,
+		maxLineSize: maxLineSizeFlag,
 	}
 }
 
@@ -51,30 +98,156 @@ func (pumper *LogsPumper) Pump() {
 	pumper.waitGroup.Add(2)
 
 	// reading from stdout & stderr
-	go pump(pumper.stdout, pumper.notifyStdout, &pumper.waitGroup)
-	go pump(pumper.stderr, pumper.notifyStderr, &pumper.waitGroup)
+	go pump(pumper.stdout, pumper.newSplitter(pumper.notifyStdout), &pumper.waitGroup)
+	go pump(pumper.stderr, pumper.newSplitter(pumper.notifyStderr), &pumper.waitGroup)
 
 	// cleanup after pumping is complete
 	pumper.waitGroup.Wait()
 	pumper.notifyClose()
 }
 
-func pump(r io.Reader, lineConsumer acceptLine, wg *sync.WaitGroup) {
+// Limits the positions which the partial lines are split at e.g. so the secrets
+// are not split between the published part of the line and its rest
+func (pumper *LogsPumper) SetSplitLimit(limit func(line string, position int) int) {
+	pumper.limit = limit
+}
+
+func (pumper *LogsPumper) newSplitter(consume acceptLine) *lineSplitter {
+	return &lineSplitter{
+		consume:     consume,
+		maxLineSize: pumper.maxLineSize,
+		limit:       pumper.limit,
+	}
+}
+
+func pump(r io.Reader, splitter *lineSplitter, wg *sync.WaitGroup) {
 	defer wg.Done()
-	br := bufio.NewReader(r)
+
+	// Reading is blocking, so it is done separately from waiting for the idle timeout
+	chunks := make(chan []byte)
+	var readErr error
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, pumpBufferSize)
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunks <- buf[:n]
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+		}
+	}()
+
+	idle := time.NewTimer(PartialLineTimeout)
+	idle.Stop()
+	defer idle.Stop()
 	for {
-		line, err := br.ReadBytes('\n')
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				splitter.flush(true)
 
-		if err != nil {
-			// handle not normal exit
-			if err != io.EOF {
-				log.Println("Error pumping: " + err.Error())
+				// handle not normal exit
+				if readErr != io.EOF {
+					log.Println("Error pumping: " + readErr.Error())
+				}
+				return
 			}
+			idle.Stop()
+			splitter.write(chunk)
+			if len(splitter.line) > 0 {
+				idle.Reset(PartialLineTimeout)
+			}
+		case <-idle.C:
+			splitter.flush(false)
+		}
+	}
+}
+
+func (ls *lineSplitter) write(data []byte) {
+	for _, b := range data {
+		switch {
+		case b == '\n' && ls.afterCR:
+			ls.afterCR = false
+		case b == '\n' || b == '\r':
+			ls.afterCR = b == '\r'
+			if len(ls.line) > 0 || !ls.partial {
+				ls.publish(len(ls.line))
+			}
+			ls.partial = false
+		default:
+			ls.afterCR = false
+			ls.line = append(ls.line, b)
+			if ls.maxLineSize > 0 && len(ls.line) >= ls.maxLineSize {
+				// The line is split anyway if the limit doesn't allow it, so the buffer is not growing infinitely
+				n := ls.splitPosition()
+				if n == 0 {
+					n = runeBoundary(ls.line)
+				}
+				ls.publish(n)
+				ls.partial = true
+			}
+		}
+	}
+}
+
+// Publishes the partial line. If the output is not finished then
+// the incomplete UTF-8 character at the end of the line is left in the buffer
+func (ls *lineSplitter) flush(finished bool) {
+	if len(ls.line) == 0 {
+		return
+	}
+	if finished {
+		ls.publish(len(ls.line))
+	} else if ls.limit == nil {
+		ls.publish(runeBoundary(ls.line))
+	} else {
+		n := ls.splitPosition()
+		if n == 0 {
+			// The whole line is awaited
 			return
 		}
+		ls.publish(n)
+	}
+	ls.partial = true
+}
+
+// Returns the position which the partial line is split at,
+// 0 if the limit doesn't allow to split the line
+func (ls *lineSplitter) splitPosition() int {
+	n := runeBoundary(ls.line)
+	if ls.limit != nil {
+		n = ls.limit(string(ls.line), n)
+	}
+	return n
+}
 
-		lineConsumer(string(line[:len(line) - 1]))
+// Publishes the first n bytes of the buffered line
+func (ls *lineSplitter) publish(n int) {
+	if n == 0 && len(ls.line) != 0 {
+		// The line consists of the incomplete character only
+		n = len(ls.line)
+	}
+	ls.consume(string(ls.line[:n]))
+	ls.line = append(ls.line[:0], ls.line[n:]...)
+}
+
+// Returns the length of the data without the incomplete
+// UTF-8 character at the end, if there is no such character
+// then the length of the whole data is returned
+func runeBoundary(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
 	}
+	return len(data)
 }
 
 func (pumper *LogsPumper) notifyStdout(line string) {
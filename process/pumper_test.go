@@ -0,0 +1,74 @@
+package process_test
+
+import (
+	"github.com/evoevodin/machine-agent/process"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Collects the lines pumped from stdout
+type linesCollector struct {
+	lines []string
+}
+
+func (lc *linesCollector) OnStdout(line string, time time.Time) {
+	lc.lines = append(lc.lines, line)
+}
+
+func (lc *linesCollector) OnStderr(line string, time time.Time) {}
+
+func (lc *linesCollector) Close() {}
+
+func TestPumperKeepsLastUnterminatedLine(t *testing.T) {
+	lines := pumpLines(strings.NewReader("line1\r\nline2\rline3\n\nline4"))
+	checkLines(t, lines, []string{"line1", "line2", "line3", "", "line4"})
+}
+
+func TestPumperPublishesPartialLineWhenOutputIsIdle(t *testing.T) {
+	r, w := io.Pipe()
+	go func() {
+		w.Write([]byte("progress 50%"))
+		time.Sleep(process.PartialLineTimeout * 2)
+		w.Write([]byte("\rprogress 100%\n"))
+		w.Close()
+	}()
+	checkLines(t, pumpLines(r), []string{"progress 50%", "progress 100%"})
+}
+
+func TestPumperSplitsLongLinesWithoutBreakingCharacters(t *testing.T) {
+	long := strings.Repeat("ж", 10000)
+	lines := pumpLines(strings.NewReader(long + "\n"))
+	if len(lines) < 2 {
+		t.Fatalf("Expected long line to be split, but got %d lines", len(lines))
+	}
+	if strings.Join(lines, "") != long {
+		t.Fatal("Expected split lines to form the original line")
+	}
+	for _, line := range lines {
+		if !utf8.ValidString(line) {
+			t.Fatal("Expected lines to be split by character boundaries")
+		}
+	}
+}
+
+func pumpLines(stdout io.Reader) []string {
+	collector := &linesCollector{}
+	pumper := process.NewPumper(stdout, strings.NewReader(""))
+	pumper.AddConsumer(collector)
+	pumper.Pump()
+	return collector.lines
+}
+
+func checkLines(t *testing.T, lines []string, expected []string) {
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected lines %q, but got %q", expected, lines)
+	}
+	for idx := range lines {
+		if lines[idx] != expected[idx] {
+			t.Fatalf("Expected lines %q, but got %q", expected, lines)
+		}
+	}
+}
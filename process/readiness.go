@@ -0,0 +1,205 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"github.com/evoevodin/machine-agent/op"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the port or url is checked if the probe doesn't define it
+	DefaultReadinessPeriod = time.Second
+)
+
+// Defines how to detect that the process is ready e.g. the server is ready
+// to accept connections. Exactly one of the log pattern, port or url must be specified
+type ReadinessProbe struct {
+	// The regular expression matched against each stdout and stderr line,
+	// the process is ready when any line matches it
+	LogPattern string `json:"logPattern"`
+
+	// The TCP port on localhost, the process is ready when it accepts connections
+	Port int `json:"port"`
+
+	// The http(s) url on localhost, the process is ready when it responds with 2xx status
+	HttpUrl string `json:"httpUrl"`
+
+	// How often the port or url is checked(in seconds), the default is 1 second
+	Period int `json:"period"`
+
+	// The time to wait for the readiness(in seconds), if it is reached
+	// then process_ready_timeout event is published. 0 means no timeout
+	Timeout int `json:"timeout"`
+}
+
+// Checks the readiness of the single process run, the check is finished
+// when the process is ready, the timeout is reached or the run is finished.
+// The check consumes process logs to match them against the log pattern
+type readinessCheck struct {
+	mp      *MachineProcess
+	probe   *ReadinessProbe
+	pattern *regexp.Regexp
+	once    sync.Once
+
+	// Closed when the check is finished
+	done chan bool
+}
+
+func newReadinessCheck(mp *MachineProcess, probe *ReadinessProbe) *readinessCheck {
+	rc := &readinessCheck{
+		mp:    mp,
+		probe: probe,
+		done:  make(chan bool),
+	}
+	if probe.LogPattern != "" {
+		// The pattern is validated before the process is started
+		rc.pattern, _ = regexp.Compile(probe.LogPattern)
+	}
+	return rc
+}
+
+// Starts waiting for the timeout and polling the port or url if needed
+func (rc *readinessCheck) start() {
+	if rc.probe.Timeout > 0 {
+		go func() {
+			select {
+			case <-time.After(time.Duration(rc.probe.Timeout) * time.Second):
+				rc.finish(ProcessReadyTimeoutEventType)
+			case <-rc.done:
+			}
+		}()
+	}
+	if rc.pattern == nil {
+		go rc.poll()
+	}
+}
+
+func (rc *readinessCheck) poll() {
+	period := DefaultReadinessPeriod
+	if rc.probe.Period > 0 {
+		period = time.Duration(rc.probe.Period) * time.Second
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		if rc.isReady(period) {
+			rc.finish(ProcessReadyEventType)
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-rc.done:
+			return
+		}
+	}
+}
+
+// Returns true if the port accepts connections or the url responds with 2xx status
+func (rc *readinessCheck) isReady(timeout time.Duration) bool {
+	if rc.probe.Port > 0 {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", rc.probe.Port), timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(rc.probe.HttpUrl)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// Finishes the check publishing the event of the given type,
+// if the type is empty then the check is finished silently.
+// Only the first call takes effect
+func (rc *readinessCheck) finish(eventType string) {
+	rc.once.Do(func() {
+		close(rc.done)
+		if eventType == "" {
+			return
+		}
+		if eventType == ProcessReadyEventType {
+			rc.mp.mutex.Lock()
+			rc.mp.Ready = true
+			rc.mp.mutex.Unlock()
+			rc.mp.persist()
+		}
+		rc.mp.notifySubs(op.NewEventNow(eventType, rc.mp.newStatusEventBody()), ProcessStatusBit)
+	})
+}
+
+func (rc *readinessCheck) OnStdout(line string, time time.Time) {
+	rc.match(line)
+}
+
+func (rc *readinessCheck) OnStderr(line string, time time.Time) {
+	rc.match(line)
+}
+
+// Called when the process run is finished, so it can't become ready anymore
+func (rc *readinessCheck) Close() {
+	rc.finish("")
+}
+
+func (rc *readinessCheck) match(line string) {
+	if rc.pattern != nil && rc.pattern.MatchString(line) {
+		rc.finish(ProcessReadyEventType)
+	}
+}
+
+// Checks whether readiness probe is valid
+func checkReadinessProbe(probe *ReadinessProbe) error {
+	defined := 0
+	for _, isSet := range []bool{probe.LogPattern != "", probe.Port != 0, probe.HttpUrl != ""} {
+		if isSet {
+			defined++
+		}
+	}
+	if defined != 1 {
+		return errors.New("Exactly one of readiness 'logPattern', 'port', 'httpUrl' required")
+	}
+	if probe.LogPattern != "" {
+		if _, err := regexp.Compile(probe.LogPattern); err != nil {
+			return errors.New(fmt.Sprintf("Readiness log pattern is not valid. %s", err.Error()))
+		}
+	}
+	if probe.Port < 0 || probe.Port > 65535 {
+		return errors.New("Readiness port must be in range 1-65535")
+	}
+	if probe.HttpUrl != "" {
+		if err := checkLocalUrl(probe.HttpUrl); err != nil {
+			return err
+		}
+	}
+	if probe.Period < 0 || probe.Timeout < 0 {
+		return errors.New("Readiness 'period' and 'timeout' must be >= 0")
+	}
+	return nil
+}
+
+// Checks that the url is http(s) url which points to localhost
+func checkLocalUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Readiness url is not valid. %s", err.Error()))
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("Readiness url must be either http or https url")
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return nil
+	default:
+		return errors.New("Readiness url must point to localhost")
+	}
+}
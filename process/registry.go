@@ -0,0 +1,279 @@
+package process
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	lastPidFilename = "last-pid"
+	recordsDirname  = "processes"
+
+	// How often the liveness of the processes which are not children of the agent is checked
+	adoptedPollPeriod = time.Second
+
+	// The maximum difference between the start time of the native process
+	// and the start time of the machine process, which is set right after the native process started
+	startTimeTolerance = 2 * time.Second
+)
+
+var (
+	// The directory where the processes registry is persisted,
+	// if it is empty then the 'state' subdirectory of the logs dir is used
+	StateDir string
+
+	// Serializes registry writes, so the latest state is always written last
+	registryMutex sync.Mutex
+
+	// The greatest pid written to the registry
+	persistedPid uint64
+)
+
+// The persisted state of the machine process
+type processRecord struct {
+	Process  *MachineProcess `json:"process"`
+	Command  Command         `json:"command"`
+	LogFile  string          `json:"logFile"`
+	LastUsed time.Time       `json:"lastUsed"`
+}
+
+func init() {
+	flag.StringVar(&StateDir, "state-dir", "",
+		`Directory where the processes registry is persisted, so the processes
+		survive the agent restart. The default is the 'state' subdirectory of the logs dir`)
+}
+
+// Loads the processes persisted by the previous agent run.
+// Processes which were alive are re-adopted if their native process
+// is still running, otherwise they are marked as lost
+func LoadProcesses() error {
+	lastPid, err := readLastPid()
+	if err != nil {
+		return err
+	}
+	names, err := readDirNames(filepath.Join(stateDir(), recordsDirname))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	loaded := []*MachineProcess{}
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		filename := filepath.Join(stateDir(), recordsDirname, name)
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.Printf("Couldn't read process record '%s'. %s", filename, err.Error())
+			continue
+		}
+		record := &processRecord{}
+		if err := json.Unmarshal(content, record); err != nil || record.Process == nil {
+			log.Printf("Couldn't load process record '%s', the record is broken", filename)
+			continue
+		}
+		mp := record.Process
+		mp.source = record.Command
+		mp.logfileName = record.LogFile
+		mp.lastUsed = record.LastUsed
+		if mp.Pid > lastPid {
+			lastPid = mp.Pid
+		}
+		loaded = append(loaded, mp)
+	}
+
+	atomic.StoreUint64(&prevPid, lastPid)
+	registryMutex.Lock()
+	persistedPid = lastPid
+	registryMutex.Unlock()
+
+	// The processes are completely loaded before they are registered,
+	// so the lost ones are never seen alive
+	lost := []*MachineProcess{}
+	for _, mp := range loaded {
+		if mp.Alive && !isSameNativeProcess(mp.NativePid, mp.StartTime, !mp.Adopted) {
+			mp.Alive = false
+			mp.Paused = false
+			mp.Lost = true
+			lost = append(lost, mp)
+		}
+	}
+
+	processes.Lock()
+	for _, mp := range loaded {
+		processes.items[mp.Pid] = mp
+	}
+	processes.Unlock()
+
+	for _, mp := range loaded {
+		if mp.Alive {
+			go mp.watchAdopted()
+		}
+	}
+	for _, mp := range lost {
+		mp.persist()
+	}
+	return nil
+}
+
+// Writes the current state of the process to the registry
+func (mp *MachineProcess) persist() {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	mp.mutex.RLock()
+	content, err := json.Marshal(&processRecord{
+		Process:  mp,
+		Command:  persistedCommand(mp.source),
+		LogFile:  mp.logfileName,
+		LastUsed: mp.lastUsed,
+	})
+	mp.mutex.RUnlock()
+	if err != nil {
+		log.Printf("Couldn't persist process '%d'. %s", mp.Pid, err.Error())
+		return
+	}
+
+	if mp.Pid > persistedPid {
+		if err := writeStateFile(lastPidFilename, []byte(strconv.FormatUint(mp.Pid, 10))); err != nil {
+			log.Printf("Couldn't persist the last pid. %s", err.Error())
+		} else {
+			persistedPid = mp.Pid
+		}
+	}
+	if err := writeStateFile(recordFilename(mp.Pid), content); err != nil {
+		log.Printf("Couldn't persist process '%d'. %s", mp.Pid, err.Error())
+	}
+}
+
+// Returns the command without the secrets and the values of the secret variables,
+// as the secrets must not be stored anywhere besides the memory of the agent
+func persistedCommand(command Command) Command {
+	secret := map[string]bool{}
+	for _, secrets := range []*Secrets{agentSecrets, command.Secrets} {
+		if secrets != nil {
+			for _, name := range secrets.Env {
+				secret[name] = true
+			}
+		}
+	}
+	command.Secrets = nil
+	if len(secret) != 0 && len(command.Env) != 0 {
+		env := map[string]string{}
+		for key, value := range command.Env {
+			if secret[key] {
+				value = SecretMask
+			}
+			env[key] = value
+		}
+		command.Env = env
+	}
+	return command
+}
+
+// Removes the process from the registry
+func removeRecord(pid uint64) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	filename := filepath.Join(stateDir(), recordFilename(pid))
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		log.Printf("Couldn't remove process record '%s'. %s", filename, err.Error())
+	}
+}
+
+// Polls the liveness of the process which is not a child of the agent e.g. adopted one,
+// when its native process finishes the process dies with unknown exit code
+func (mp *MachineProcess) watchAdopted() {
+	ticker := time.NewTicker(adoptedPollPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		mp.mutex.RLock()
+		nativePid, startTime, adopted := mp.NativePid, mp.StartTime, mp.Adopted
+		mp.mutex.RUnlock()
+		if !isSameNativeProcess(nativePid, startTime, !adopted) {
+			break
+		}
+	}
+
+	end := time.Now()
+	mp.mutex.Lock()
+	exit := &ExitInfo{
+		ExitCode: -1,
+		EndTime:  end,
+		Duration: end.Sub(mp.StartTime).Nanoseconds() / int64(time.Millisecond),
+		TimedOut: mp.TimedOut,
+	}
+	if mp.killSignal != 0 {
+		exit.KillSignal = signalName(mp.killSignal)
+	}
+	if mp.killTimer != nil {
+		mp.killTimer.Stop()
+		mp.killTimer = nil
+	}
+	mp.Paused = false
+	mp.mutex.Unlock()
+	mp.die(exit)
+}
+
+// Returns true if the native process with the given pid is alive, it was started
+// at the given time, which guarantees that the pid is not reused by another process,
+// and it is the leader of its process group if the leadership is required
+func isSameNativeProcess(nativePid int, startTime time.Time, leader bool) bool {
+	stat, err := readProcStat(nativePid)
+	if err != nil || stat.State == "Z" || (leader && stat.Pgrp != nativePid) {
+		return false
+	}
+	bootTime, err := readBootTime()
+	if err != nil {
+		return false
+	}
+	diff := startTime.Sub(procStartTime(bootTime, stat.StartTime))
+	return diff > -startTimeTolerance && diff < startTimeTolerance
+}
+
+func readLastPid() (uint64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(stateDir(), lastPidFilename))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// Atomically writes the file relative to the state dir,
+// the file is replaced only when the content is fully written.
+// The records contain the command environment, so the state is readable only by the agent's user
+func writeStateFile(name string, content []byte) error {
+	filename := filepath.Join(stateDir(), name)
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func recordFilename(pid uint64) string {
+	return filepath.Join(recordsDirname, fmt.Sprintf("pid-%d.json", pid))
+}
+
+func stateDir() string {
+	if StateDir != "" {
+		return StateDir
+	}
+	return filepath.Join(LogsDir, "state")
+}
@@ -7,11 +7,11 @@ import (
 	"github.com/evoevodin/machine-agent/rest"
 	"github.com/evoevodin/machine-agent/rest/restutil"
 	"github.com/gorilla/mux"
-	"io"
-	"math"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -24,6 +24,18 @@ var HttpRoutes = rest.RoutesGroup{
 			"/process",
 			startProcessHF,
 		},
+		{
+			"POST",
+			"Adopt Process",
+			"/process/adopt",
+			adoptProcessHF,
+		},
+		{
+			"POST",
+			"Cleanup Processes",
+			"/process/cleanup",
+			cleanupProcessesHF,
+		},
 		{
 			"GET",
 			"Get Process",
@@ -36,12 +48,84 @@ var HttpRoutes = rest.RoutesGroup{
 			"/process/{pid}",
 			killProcessHF,
 		},
+		{
+			"POST",
+			"Keep Process",
+			"/process/{pid}/keep",
+			keepProcessHF,
+		},
+		{
+			"DELETE",
+			"Unkeep Process",
+			"/process/{pid}/keep",
+			unkeepProcessHF,
+		},
 		{
 			"GET",
 			"Get Process Logs",
 			"/process/{pid}/logs",
 			getProcessLogsHF,
 		},
+		{
+			"GET",
+			"Search Process Logs",
+			"/process/{pid}/logs/search",
+			searchProcessLogsHF,
+		},
+		{
+			"GET",
+			"Search Processes Logs",
+			"/process/logs/search",
+			searchProcessesLogsHF,
+		},
+		{
+			"GET",
+			"Get Processes Logs Archive",
+			"/process/logs/archive",
+			getLogsArchiveHF,
+		},
+		{
+			"POST",
+			"Write Process Input",
+			"/process/{pid}/input",
+			writeInputHF,
+		},
+		{
+			"DELETE",
+			"Close Process Input",
+			"/process/{pid}/input",
+			closeInputHF,
+		},
+		{
+			"POST",
+			"Suspend Process",
+			"/process/{pid}/suspend",
+			suspendProcessHF,
+		},
+		{
+			"POST",
+			"Resume Process",
+			"/process/{pid}/resume",
+			resumeProcessHF,
+		},
+		{
+			"POST",
+			"Resize Process Terminal",
+			"/process/{pid}/resize",
+			resizeProcessHF,
+		},
+		{
+			"GET",
+			"Get Process Stats",
+			"/process/{pid}/stats",
+			getProcessStatsHF,
+		},
+		{
+			"GET",
+			"Get Process Tree",
+			"/process/{pid}/tree",
+			getProcessTreeHF,
+		},
 		{
 			"GET",
 			"Get Processes",
@@ -69,6 +153,12 @@ var HttpRoutes = rest.RoutesGroup{
 	},
 }
 
+// The body of the process input request
+type processInput struct {
+	Text     string `json:"text"`
+	Encoding string `json:"encoding"`
+}
+
 func startProcessHF(w http.ResponseWriter, r *http.Request) error {
 	command := Command{}
 	restutil.ReadJson(r, &command)
@@ -106,6 +196,58 @@ func startProcessHF(w http.ResponseWriter, r *http.Request) error {
 	return restutil.WriteJson(w, process)
 }
 
+// The body of the process terminal resize request
+type ttySize struct {
+	Cols uint16 `json:"cols"`
+	Rows uint16 `json:"rows"`
+}
+
+// The body of the process adoption request
+type processAdoption struct {
+	NativePid int    `json:"nativePid"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+}
+
+func adoptProcessHF(w http.ResponseWriter, r *http.Request) error {
+	adoption := processAdoption{}
+	restutil.ReadJson(r, &adoption)
+	if p, ok := GetByNativePid(adoption.NativePid); ok {
+		return rest.Conflict(&AdoptedError{adoption.NativePid, p.Pid})
+	}
+
+	// If channel is provided then it becomes the first process subscriber
+	var subscriber *Subscriber
+	channelId := r.URL.Query().Get("channel")
+	if channelId != "" {
+		channel, ok := op.GetChannel(channelId)
+		if !ok {
+			m := fmt.Sprintf("Channel with id '%s' doesn't exist. Process won't be adopted", channelId)
+			return rest.NotFound(errors.New(m))
+		}
+		subscriber = &Subscriber{
+			Id:      channelId,
+			Mask:    parseTypes(r.URL.Query().Get("types")),
+			Channel: channel.Events,
+		}
+	}
+
+	process, err := AdoptProcess(adoption.NativePid, adoption.Name, adoption.Type, subscriber)
+	if err != nil {
+		if _, ok := err.(*NoNativeProcessError); ok {
+			return rest.NotFound(err)
+		}
+		if _, ok := err.(*BadAdoptionError); ok {
+			return rest.BadRequest(err)
+		}
+		if _, ok := err.(*AdoptedError); ok {
+			return rest.Conflict(err)
+		}
+		return err
+	}
+	return restutil.WriteJson(w, process)
+}
+
 func getProcessHF(w http.ResponseWriter, r *http.Request) error {
 	pid, err := parsePid(mux.Vars(r)["pid"])
 	if err != nil {
@@ -129,12 +271,171 @@ func killProcessHF(w http.ResponseWriter, r *http.Request) error {
 	if !ok {
 		return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
 	}
-	if err := p.Kill(); err != nil {
-		return err
+
+	// The process is discarded with its logs only if it is requested, the alive process can't be discarded
+	if discard, _ := strconv.ParseBool(r.URL.Query().Get("discard")); discard {
+		if _, err := p.Discard(); err != nil {
+			return asRestError(err)
+		}
+		return nil
+	}
+	sig, err := parseSignal(r.URL.Query().Get("signal"), syscall.SIGKILL)
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	gracePeriod := restutil.IntQueryParam(r, "gracePeriod", 0)
+	if gracePeriod < 0 {
+		return rest.BadRequest(errors.New("Required 'gracePeriod' to be >= 0"))
+	}
+	if err := p.KillWithSignal(sig, time.Duration(gracePeriod)*time.Second); err != nil {
+		return asRestError(err)
+	}
+	return nil
+}
+
+func cleanupProcessesHF(w http.ResponseWriter, r *http.Request) error {
+	return restutil.WriteJson(w, NewCleaner().Cleanup())
+}
+
+func keepProcessHF(w http.ResponseWriter, r *http.Request) error {
+	return setKeepHF(w, r, true)
+}
+
+func unkeepProcessHF(w http.ResponseWriter, r *http.Request) error {
+	return setKeepHF(w, r, false)
+}
+
+func setKeepHF(w http.ResponseWriter, r *http.Request, keep bool) error {
+	pid, err := parsePid(mux.Vars(r)["pid"])
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	p, ok := Get(pid)
+	if !ok {
+		return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
+	}
+	p.SetKeep(keep)
+	return restutil.WriteJson(w, p)
+}
+
+func writeInputHF(w http.ResponseWriter, r *http.Request) error {
+	pid, err := parsePid(mux.Vars(r)["pid"])
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	p, ok := Get(pid)
+	if !ok {
+		return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
+	}
+	input := processInput{}
+	restutil.ReadJson(r, &input)
+	data, err := decodeInput(input.Text, input.Encoding)
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	if err := p.WriteInput(data); err != nil {
+		return asRestError(err)
+	}
+	return nil
+}
+
+func closeInputHF(w http.ResponseWriter, r *http.Request) error {
+	pid, err := parsePid(mux.Vars(r)["pid"])
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	p, ok := Get(pid)
+	if !ok {
+		return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
+	}
+	if err := p.CloseInput(); err != nil {
+		return asRestError(err)
+	}
+	return nil
+}
+
+func suspendProcessHF(w http.ResponseWriter, r *http.Request) error {
+	pid, err := parsePid(mux.Vars(r)["pid"])
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	p, ok := Get(pid)
+	if !ok {
+		return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
+	}
+	if err := p.Suspend(); err != nil {
+		return asRestError(err)
+	}
+	return restutil.WriteJson(w, p)
+}
+
+func resumeProcessHF(w http.ResponseWriter, r *http.Request) error {
+	pid, err := parsePid(mux.Vars(r)["pid"])
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	p, ok := Get(pid)
+	if !ok {
+		return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
+	}
+	if err := p.Resume(); err != nil {
+		return asRestError(err)
+	}
+	return restutil.WriteJson(w, p)
+}
+
+func resizeProcessHF(w http.ResponseWriter, r *http.Request) error {
+	pid, err := parsePid(mux.Vars(r)["pid"])
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	p, ok := Get(pid)
+	if !ok {
+		return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
+	}
+	size := ttySize{}
+	restutil.ReadJson(r, &size)
+	if size.Cols == 0 || size.Rows == 0 {
+		return rest.BadRequest(errors.New("Required 'cols' and 'rows' to be > 0"))
+	}
+	if err := p.Resize(size.Cols, size.Rows); err != nil {
+		return asRestError(err)
 	}
 	return nil
 }
 
+func getProcessStatsHF(w http.ResponseWriter, r *http.Request) error {
+	pid, err := parsePid(mux.Vars(r)["pid"])
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	p, ok := Get(pid)
+	if !ok {
+		return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
+	}
+	stats, err := p.Stats()
+	if err != nil {
+		return asRestError(err)
+	}
+	return restutil.WriteJson(w, stats)
+}
+
+func getProcessTreeHF(w http.ResponseWriter, r *http.Request) error {
+	pid, err := parsePid(mux.Vars(r)["pid"])
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	p, ok := Get(pid)
+	if !ok {
+		return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
+	}
+	tree, err := p.Tree()
+	if err != nil {
+		return asRestError(err)
+	}
+	return restutil.WriteJson(w, tree)
+}
+
 func getProcessLogsHF(w http.ResponseWriter, r *http.Request) error {
 	pid, err := parsePid(mux.Vars(r)["pid"])
 	if err != nil {
@@ -159,9 +460,30 @@ func getProcessLogsHF(w http.ResponseWriter, r *http.Request) error {
 		return rest.BadRequest(errors.New("Bad format of 'till', " + err.Error()))
 	}
 
-	logs, err := p.ReadLogs(from, till)
-	if err != nil {
-		return err
+	// Respond with an appropriate logs format, default json. The logs are streamed
+	// if either 'follow' is set or server-sent events are requested
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		format = "sse"
+	}
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+	follow = follow || format == "sse"
+	if follow && format != "" && format != "text" && format != "sse" {
+		return rest.BadRequest(errors.New("Only 'text' and 'sse' logs formats can be followed"))
+	}
+
+	// Parse 'after', if it is specified then only the logs
+	// with greater sequence numbers are returned. Reconnecting
+	// event source specifies the last received line in the header
+	afterStr := r.URL.Query().Get("after")
+	if afterStr == "" && format == "sse" {
+		afterStr = r.Header.Get("Last-Event-ID")
+	}
+	var afterSeq uint64
+	if afterStr != "" {
+		if afterSeq, err = strconv.ParseUint(afterStr, 10, 64); err != nil {
+			return rest.BadRequest(errors.New("Required 'after' to be the sequence number of the log line"))
+		}
 	}
 
 	// limit logs from the latest to the earliest
@@ -175,24 +497,172 @@ func getProcessLogsHF(w http.ResponseWriter, r *http.Request) error {
 	if skip < 0 {
 		return rest.BadRequest(errors.New("Required 'skip' to be >= 0"))
 	}
-	len := len(logs)
-	fromIdx := int(math.Max(float64(len-limit-skip), 0))
-	toIdx := len - int(math.Min(float64(skip), float64(len)))
-
-	// Respond with an appropriate logs format, default json
-	format := r.URL.Query().Get("format")
-	switch strings.ToLower(format) {
-	case "text":
-		for _, item := range logs[fromIdx:toIdx] {
-			line := fmt.Sprintf("[%s] %s \t %s", item.Kind, item.Time.Format(DateTimeFormat), item.Text)
-			io.WriteString(w, line)
+
+	// The followed logs are read till the end, as the rest of them is streamed
+	if follow {
+		till = time.Now()
+		skip = 0
+	}
+	mask := parseTypes(r.URL.Query().Get("types"))
+
+	// The downloaded logs are not limited, so they are written as they are read
+	download, _ := strconv.ParseBool(r.URL.Query().Get("download"))
+	if format == "" {
+		format = JsonLogsFormat
+	}
+	if !follow {
+		if err := checkLogsFormat(format); err != nil {
+			return rest.BadRequest(err)
+		}
+	}
+	if download && !follow {
+		if err := startDownload(w, fmt.Sprintf("pid-%d.%s", pid, logsFileExtension(format)), logsContentType(format)); err != nil {
+			return err
 		}
+		_, err := p.ExportLogs(w, format, from, till, afterSeq, mask)
+		return err
+	}
+
+	logs, err := p.ReadLastLogs(from, till, afterSeq, mask, limit, skip)
+	if err != nil {
+		return err
+	}
+	if follow {
+		lastSeq := afterSeq
+		if len(logs) != 0 {
+			lastSeq = logs[len(logs)-1].Seq
+		}
+		return streamLogs(w, r, p, logs, mask, from, lastSeq, format == "sse")
+	}
+	if format == JsonLogsFormat {
+		return restutil.WriteJson(w, logs)
+	}
+	lw, err := newLogsWriter(w, format)
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	w.Header().Set("Content-Type", logsContentType(format))
+	for _, message := range logs {
+		if err := lw.write(message); err != nil {
+			return err
+		}
+	}
+	return lw.close()
+}
+
+func getLogsArchiveHF(w http.ResponseWriter, r *http.Request) error {
+	processes := []*MachineProcess{}
+	for _, pidStr := range strings.Split(r.URL.Query().Get("pids"), ",") {
+		pid, err := parsePid(strings.TrimSpace(pidStr))
+		if err != nil {
+			return rest.BadRequest(errors.New("Required 'pids' to be the ids of the processes separated by comma"))
+		}
+		p, ok := Get(pid)
+		if !ok {
+			return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
+		}
+		processes = append(processes, p)
+	}
+	from, err := parseTime(r.URL.Query().Get("from"), time.Time{})
+	if err != nil {
+		return rest.BadRequest(errors.New("Bad format of 'from', " + err.Error()))
+	}
+	till, err := parseTime(r.URL.Query().Get("till"), time.Now())
+	if err != nil {
+		return rest.BadRequest(errors.New("Bad format of 'till', " + err.Error()))
+	}
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = NdjsonLogsFormat
+	}
+	if err := checkLogsFormat(format); err != nil {
+		return rest.BadRequest(err)
+	}
+	archiveFormat := strings.ToLower(r.URL.Query().Get("archive"))
+	contentType := "application/gzip"
+	switch archiveFormat {
+	case "", TarGzArchiveFormat:
+		archiveFormat = TarGzArchiveFormat
+	case ZipArchiveFormat:
+		contentType = "application/zip"
 	default:
-		return restutil.WriteJson(w, logs[fromIdx:toIdx])
+		return rest.BadRequest(errors.New(fmt.Sprintf("Required 'archive' to be either '%s' or '%s'", TarGzArchiveFormat, ZipArchiveFormat)))
 	}
+
+	filename := fmt.Sprintf("logs-%s.%s", time.Now().Format("20060102-150405"), archiveFormat)
+	if err := startDownload(w, filename, contentType); err != nil {
+		return err
+	}
+	return WriteLogsArchive(w, archiveFormat, format, processes, from, till, parseTypes(r.URL.Query().Get("types")))
+}
+
+// Sets the headers of the file download, the download is not limited by the server write timeout
+func startDownload(w http.ResponseWriter, filename string, contentType string) error {
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
 	return nil
 }
 
+func searchProcessLogsHF(w http.ResponseWriter, r *http.Request) error {
+	pid, err := parsePid(mux.Vars(r)["pid"])
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	p, ok := Get(pid)
+	if !ok {
+		return rest.NotFound(errors.New(fmt.Sprintf("No process with id '%d'", pid)))
+	}
+	query, err := parseLogsQuery(r)
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	matches, err := p.SearchLogs(query)
+	if err != nil {
+		return asRestError(err)
+	}
+	return restutil.WriteJson(w, matches)
+}
+
+func searchProcessesLogsHF(w http.ResponseWriter, r *http.Request) error {
+	query, err := parseLogsQuery(r)
+	if err != nil {
+		return rest.BadRequest(err)
+	}
+	matches, err := SearchProcessesLogs(r.URL.Query().Get("name"), r.URL.Query().Get("type"), query)
+	if err != nil {
+		return asRestError(err)
+	}
+	return restutil.WriteJson(w, matches)
+}
+
+// Parses the logs search query from the request parameters
+func parseLogsQuery(r *http.Request) (*LogsQuery, error) {
+	params := r.URL.Query()
+	from, err := parseTime(params.Get("from"), time.Time{})
+	if err != nil {
+		return nil, errors.New("Bad format of 'from', " + err.Error())
+	}
+	till, err := parseTime(params.Get("till"), time.Now())
+	if err != nil {
+		return nil, errors.New("Bad format of 'till', " + err.Error())
+	}
+	isRegexp, _ := strconv.ParseBool(params.Get("regexp"))
+	ignoreCase, _ := strconv.ParseBool(params.Get("ignoreCase"))
+	return &LogsQuery{
+		Text:       params.Get("text"),
+		Regexp:     isRegexp,
+		IgnoreCase: ignoreCase,
+		Mask:       parseTypes(params.Get("types")),
+		From:       from,
+		Till:       till,
+		Context:    restutil.IntQueryParam(r, "context", 0),
+		Limit:      restutil.IntQueryParam(r, "limit", DefaultLogsLimit),
+	}, nil
+}
+
 func getProcessesHF(w http.ResponseWriter, r *http.Request) error {
 	all, err := strconv.ParseBool(r.URL.Query().Get("all"))
 	if err != nil {
@@ -254,6 +724,9 @@ func subscribeHF(w http.ResponseWriter, r *http.Request) error {
 	if afterStr == "" {
 		return p.AddSubscriber(subscriber)
 	}
+	if seq, err := strconv.ParseUint(afterStr, 10, 64); err == nil {
+		return p.RestoreSubscriberAfterSeq(subscriber, seq)
+	}
 	after, err := time.Parse(DateTimeFormat, afterStr)
 	if err != nil {
 		return rest.BadRequest(errors.New("Bad format of 'after', " + err.Error()))
@@ -291,3 +764,26 @@ func updateSubscriberHF(w http.ResponseWriter, r *http.Request) error {
 	p.UpdateSubscriber(channel.Id, maskFromTypes(types))
 	return nil
 }
+
+// Converts process errors to an appropriate api errors
+func asRestError(err error) error {
+	if _, ok := err.(*NotAliveError); ok {
+		return rest.Conflict(err)
+	}
+	if _, ok := err.(*AliveError); ok {
+		return rest.Conflict(err)
+	}
+	if _, ok := err.(*RestartingError); ok {
+		return rest.Conflict(err)
+	}
+	if _, ok := err.(*InputClosedError); ok {
+		return rest.Conflict(err)
+	}
+	if _, ok := err.(*NoTtyError); ok {
+		return rest.BadRequest(err)
+	}
+	if _, ok := err.(*BadLogsQueryError); ok {
+		return rest.BadRequest(err)
+	}
+	return err
+}
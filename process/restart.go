@@ -0,0 +1,90 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	NeverRestartPolicy     = "never"
+	OnFailureRestartPolicy = "on-failure"
+	AlwaysRestartPolicy    = "always"
+
+	// The delay before the first restart if the policy doesn't define it
+	DefaultRestartBackoff = time.Second
+
+	// The maximum delay between restarts
+	MaxRestartBackoff = 5 * time.Minute
+
+	// How long the process must run, so the delay before its restart is reset to the first one
+	DefaultRestartBackoffResetPeriod = 10 * time.Minute
+)
+
+// How long the process must run, so the delay before its restart is reset to the first one
+var RestartBackoffResetPeriod = DefaultRestartBackoffResetPeriod
+
+// Defines when the process is relaunched after it finished
+type RestartPolicy struct {
+	// One of 'never'(default), 'on-failure' which restarts the process only
+	// if it exited with non-zero code or was terminated by a signal, and 'always'
+	Policy string `json:"policy"`
+
+	// The maximum number of restarts, 0 means that the number is not limited
+	MaxRetries int `json:"maxRetries"`
+
+	// The delay before the first restart(in seconds), it is doubled
+	// with each next restart but not more than 5 minutes. The default is 1 second
+	Backoff int `json:"backoff"`
+}
+
+// Returns true if the process should be restarted after it finished
+// with the given exit info and was already restarted the given number of times
+func (rp *RestartPolicy) shouldRestart(exit *ExitInfo, restarts int) bool {
+	if rp.MaxRetries > 0 && restarts >= rp.MaxRetries {
+		return false
+	}
+	switch rp.Policy {
+	case AlwaysRestartPolicy:
+		return true
+	case OnFailureRestartPolicy:
+		return exit.ExitCode != 0 || exit.OomKilled
+	default:
+		return false
+	}
+}
+
+// Returns the delay before the restart with the given attempt number
+func (rp *RestartPolicy) backoff(attempt int) time.Duration {
+	delay := DefaultRestartBackoff
+	if rp.Backoff > 0 {
+		delay = time.Duration(rp.Backoff) * time.Second
+	}
+	for i := 1; i < attempt && delay < MaxRestartBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MaxRestartBackoff {
+		return MaxRestartBackoff
+	}
+	return delay
+}
+
+// Checks whether restart policy is valid
+func checkRestartPolicy(rp *RestartPolicy) error {
+	switch rp.Policy {
+	case "", NeverRestartPolicy, OnFailureRestartPolicy, AlwaysRestartPolicy:
+	default:
+		m := fmt.Sprintf("Restart policy must be one of '%s', '%s', '%s'",
+			NeverRestartPolicy,
+			OnFailureRestartPolicy,
+			AlwaysRestartPolicy)
+		return errors.New(m)
+	}
+	if rp.MaxRetries < 0 {
+		return errors.New("Required 'maxRetries' to be >= 0")
+	}
+	if rp.Backoff < 0 {
+		return errors.New("Required 'backoff' to be >= 0")
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The text which the secrets are replaced with in the process output
+const SecretMask = "****"
+
+var (
+	secretsFileFlag string
+
+	// The secrets which are masked in the output of all the processes, see LoadSecrets
+	agentSecrets = &Secrets{}
+)
+
+// Declares the secrets which are masked in the process output
+// before the output is written to the logs and published to the subscribers
+type Secrets struct {
+	// The values which are masked wherever they appear in the output
+	Values []string `json:"values"`
+
+	// The regular expressions which matches are masked. If the expression has groups
+	// then only the first group of the match is masked e.g. 'password=(\S+)',
+	// the whole match is masked if the first group doesn't participate in it
+	Patterns []string `json:"patterns"`
+
+	// The names of the command environment variables which values are masked,
+	// including the variables which the command inherits from the agent's environment
+	Env []string `json:"env"`
+}
+
+// Masks the secrets in the output lines
+type secretsMasker struct {
+	patterns []*regexp.Regexp
+
+	// The secret values, including the values of the secret variables
+	values []string
+}
+
+func init() {
+	flag.StringVar(&secretsFileFlag, "secrets-file", "",
+		`The json file which declares the secrets masked in the output of all the processes
+		e.g. {"values": ["qwerty"], "patterns": ["password=(\\S+)"], "env": ["GITHUB_TOKEN"]}`)
+}
+
+// Loads the secrets declared in the file set with the -secrets-file flag
+func LoadSecrets() error {
+	if secretsFileFlag == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(secretsFileFlag)
+	if err != nil {
+		return err
+	}
+	secrets := &Secrets{}
+	if err := json.Unmarshal(content, secrets); err != nil {
+		return errors.New(fmt.Sprintf("Secrets file '%s' is not valid. %s", secretsFileFlag, err.Error()))
+	}
+	if err := checkSecrets(secrets); err != nil {
+		return err
+	}
+	agentSecrets = secrets
+	return nil
+}
+
+// Checks whether secrets are valid
+func checkSecrets(secrets *Secrets) error {
+	for _, pattern := range secrets.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Secret pattern is not valid. %s", err.Error()))
+		}
+		if re.MatchString("") {
+			return errors.New(fmt.Sprintf("Secret pattern '%s' matches an empty string", pattern))
+		}
+	}
+	return nil
+}
+
+// Creates the masker of the secrets declared by the command and the agent,
+// returns nil if there is nothing to mask
+func newSecretsMasker(command Command) *secretsMasker {
+	values := []string{}
+	patterns := []string{}
+	env := commandVars(command)
+	for _, secrets := range []*Secrets{agentSecrets, command.Secrets} {
+		if secrets == nil {
+			continue
+		}
+		values = append(values, secrets.Values...)
+		patterns = append(patterns, secrets.Patterns...)
+		for _, name := range secrets.Env {
+			values = append(values, env[name])
+		}
+	}
+
+	// The longer values are matched first, so the value
+	// which includes another one is masked completely
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	quoted := []string{}
+	for _, value := range values {
+		if value != "" {
+			quoted = append(quoted, regexp.QuoteMeta(value))
+		}
+	}
+	if len(quoted) != 0 {
+		patterns = append([]string{strings.Join(quoted, "|")}, patterns...)
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	masker := &secretsMasker{values: values}
+	for _, pattern := range patterns {
+		// The patterns are checked before the process is started
+		if re, err := regexp.Compile(pattern); err == nil {
+			masker.patterns = append(masker.patterns, re)
+		}
+	}
+	return masker
+}
+
+// Returns the environment variables of the command by their names
+func commandVars(command Command) map[string]string {
+	vars := map[string]string{}
+	if command.EnvMode != ReplaceEnvMode {
+		for _, kv := range os.Environ() {
+			if pair := strings.SplitN(kv, "=", 2); len(pair) == 2 {
+				vars[pair[0]] = pair[1]
+			}
+		}
+	}
+	for key, value := range command.Env {
+		vars[key] = value
+	}
+	return vars
+}
+
+// Replaces the secrets in the line with the mask,
+// returns the masked line and the number of the masked secrets
+func (masker *secretsMasker) mask(line string) (string, int) {
+	count := 0
+	for _, pattern := range masker.patterns {
+		matches := pattern.FindAllStringSubmatchIndex(line, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		masked := &strings.Builder{}
+		last := 0
+		for _, match := range matches {
+			start, end := match[0], match[1]
+			// Only the first group is masked if the pattern has groups and the group participates in the match
+			if len(match) > 2 && match[2] >= 0 {
+				start, end = match[2], match[3]
+			}
+			if start == end {
+				continue
+			}
+			masked.WriteString(line[last:start])
+			masked.WriteString(SecretMask)
+			last = end
+			count++
+		}
+		masked.WriteString(line[last:])
+		line = masked.String()
+	}
+	return line, count
+}
+
+// Returns the position not greater than the given one which the partial line may be split at,
+// so the secret is not split between the published part and the rest of the line.
+// As the secret may be continued by the output which is not read yet, the match which
+// reaches the end of the line and the end of the line which begins a secret value are not split.
+// The pattern which doesn't match the beginning of its secret yet can't be recognized
+func (masker *secretsMasker) splitPosition(line string, position int) int {
+	for _, pattern := range masker.patterns {
+		for _, match := range pattern.FindAllStringIndex(line, -1) {
+			if match[0] < position && (match[1] > position || match[1] == len(line)) {
+				position = match[0]
+			}
+		}
+	}
+	for _, value := range masker.values {
+		start := position - len(value) + 1
+		if start < 0 {
+			start = 0
+		}
+		for ; start < position; start++ {
+			if len(line)-start < len(value) && strings.HasPrefix(value, line[start:]) {
+				position = start
+				break
+			}
+		}
+	}
+	return position
+}
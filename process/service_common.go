@@ -1,7 +1,11 @@
 package process
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"os"
+	"os/exec"
 	"strconv"
 	"strings"
 	"time"
@@ -9,6 +13,9 @@ import (
 
 const (
 	DefaultLogsLimit = 50
+
+	TextEncoding   = "text"
+	Base64Encoding = "base64"
 )
 
 func maskFromTypes(types string) uint64 {
@@ -21,6 +28,8 @@ func maskFromTypes(types string) uint64 {
 			mask |= StdoutBit
 		case "process_status":
 			mask |= ProcessStatusBit
+		case "process_stats":
+			mask |= StatsBit
 		}
 	}
 	return mask
@@ -51,9 +60,75 @@ func checkCommand(command *Command) error {
 	if command.Name == "" {
 		return errors.New("Command name required")
 	}
-	if command.CommandLine == "" {
+	if command.CommandLine == "" && len(command.Argv) == 0 {
 		return errors.New("Command line required")
 	}
+	if len(command.Argv) != 0 {
+		if command.Argv[0] == "" {
+			return errors.New("The first argv item must be a program to execute")
+		}
+		if command.Shell != "" {
+			return errors.New("Shell can't be used in couple with argv")
+		}
+		if command.CommandLine != "" {
+			return errors.New("Command line can't be used in couple with argv")
+		}
+	}
+	if command.Shell != "" {
+		if _, err := exec.LookPath(command.Shell); err != nil {
+			return errors.New(fmt.Sprintf("Shell '%s' is not found", command.Shell))
+		}
+	}
+	switch command.EnvMode {
+	case "", MergeEnvMode, ReplaceEnvMode:
+	default:
+		return errors.New(fmt.Sprintf("Env mode must be either '%s' or '%s'", MergeEnvMode, ReplaceEnvMode))
+	}
+	for key := range command.Env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return errors.New(fmt.Sprintf("Invalid environment variable name '%s'", key))
+		}
+	}
+	if command.Timeout < 0 {
+		return errors.New("Required 'timeout' to be >= 0")
+	}
+	if command.Limits != nil {
+		if err := checkLimits(command.Limits); err != nil {
+			return err
+		}
+	}
+	if command.Logs != nil {
+		if err := checkLogsLimits(command.Logs); err != nil {
+			return err
+		}
+	}
+	if command.Secrets != nil {
+		if err := checkSecrets(command.Secrets); err != nil {
+			return err
+		}
+	}
+	if command.Restart != nil {
+		if err := checkRestartPolicy(command.Restart); err != nil {
+			return err
+		}
+	}
+	if command.Readiness != nil {
+		if err := checkReadinessProbe(command.Readiness); err != nil {
+			return err
+		}
+	}
+	if err := checkCredential(command); err != nil {
+		return err
+	}
+	if command.WorkingDir != "" {
+		info, err := os.Stat(command.WorkingDir)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Working directory '%s' doesn't exist", command.WorkingDir))
+		}
+		if !info.IsDir() {
+			return errors.New(fmt.Sprintf("Working directory '%s' is not a directory", command.WorkingDir))
+		}
+	}
 	return nil
 }
 
@@ -66,3 +141,28 @@ func parseTime(timeStr string, defTime time.Time) (time.Time, error) {
 	}
 	return time.Parse(DateTimeFormat, timeStr)
 }
+
+// Returns true if the kind of the message is included into the mask
+func isOfKinds(message *LogMessage, mask uint64) bool {
+	if message.Kind == StderrKind {
+		return mask&StderrBit != 0
+	}
+	return mask&StdoutBit != 0
+}
+
+// Decodes the input text using the given encoding,
+// if encoding is empty then the text is used as is
+func decodeInput(text string, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", TextEncoding:
+		return []byte(text), nil
+	case Base64Encoding:
+		data, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, errors.New("Bad base64 input, " + err.Error())
+		}
+		return data, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Encoding must be either '%s' or '%s'", TextEncoding, Base64Encoding))
+	}
+}
@@ -0,0 +1,54 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Signals which may be sent to the machine processes, the key
+// is the short signal name without 'SIG' prefix e.g. 'TERM'
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"ABRT": syscall.SIGABRT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"SEGV": syscall.SIGSEGV,
+	"USR2": syscall.SIGUSR2,
+	"PIPE": syscall.SIGPIPE,
+	"ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+	"TSTP": syscall.SIGTSTP,
+	"XCPU": syscall.SIGXCPU,
+	"XFSZ": syscall.SIGXFSZ,
+}
+
+// Returns the name of the signal e.g. 'SIGTERM',
+// if the signal is unknown then its number is used e.g. 'SIG34'
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return "SIG" + strconv.Itoa(int(sig))
+}
+
+// Parses the signal name e.g. 'TERM', 'SIGTERM' or 'term',
+// if the name is empty then the default signal is returned
+func parseSignal(name string, defSignal syscall.Signal) (syscall.Signal, error) {
+	if name == "" {
+		return defSignal, nil
+	}
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Unknown signal '%s'", name))
+	}
+	return sig, nil
+}
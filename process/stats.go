@@ -0,0 +1,180 @@
+package process
+
+import (
+	"flag"
+	"github.com/evoevodin/machine-agent/op"
+	"os"
+	"time"
+)
+
+// The window which the cpu usage of the requested stats is measured during
+const cpuSampleWindow = 200 * time.Millisecond
+
+var (
+	statsPeriodInSecondsFlag int
+)
+
+// Describes resources currently used by the alive process group
+type ProcessStats struct {
+	// The virtual id of the process
+	Pid uint64 `json:"pid"`
+
+	// When the stats were collected
+	Time time.Time `json:"time"`
+
+	// The number of native processes in the process group, including the descendants
+	// which left the group and the processes of the process cgroup
+	Processes int `json:"processes"`
+
+	// CPU usage of the process group, the published stats describe the usage since the previous
+	// published stats or since the process start, the requested ones are measured during the short window.
+	// 100 percents is one fully used cpu
+	CpuPercent float64 `json:"cpuPercent"`
+
+	// Resident set size of the process group(in bytes)
+	Rss int64 `json:"rss"`
+
+	// The number of threads in the process group
+	Threads int `json:"threads"`
+
+	// The number of files opened by the process group
+	OpenFiles int `json:"openFiles"`
+
+	// The number of bytes read and written by the
+	// process group from/to the storage layer
+	ReadBytes  uint64 `json:"readBytes"`
+	WriteBytes uint64 `json:"writeBytes"`
+}
+
+// The cpu time of the process group at the certain moment
+type cpuSample struct {
+	time  time.Time
+	ticks uint64
+}
+
+func init() {
+	flag.IntVar(&statsPeriodInSecondsFlag, "process-stats-period", 5,
+		`How often process_stats events are published to the subscribers(in seconds),
+		if 0 passed then the events are not published`)
+}
+
+// Collects the stats of the process group, the cpu usage is measured during the short window.
+// Returns NotAliveError if the process is dead and RestartingError if it is waiting to be relaunched
+func (mp *MachineProcess) Stats() (*ProcessStats, error) {
+	_, first, err := mp.collectStats()
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(cpuSampleWindow)
+	stats, last, err := mp.collectStats()
+	if err != nil {
+		return nil, err
+	}
+	stats.CpuPercent = cpuPercent(first, last)
+	return stats, nil
+}
+
+// Collects the stats of the process group besides the cpu usage,
+// returns the stats and the cpu time of the process group
+func (mp *MachineProcess) collectStats() (*ProcessStats, cpuSample, error) {
+	mp.mutex.RLock()
+	alive, restarting, signalPid, cgroup := mp.Alive, mp.restarting, mp.signalPid(), mp.cgroup
+	mp.mutex.RUnlock()
+	if !alive {
+		return nil, cpuSample{}, &NotAliveError{mp.Pid}
+	}
+	if restarting {
+		return nil, cpuSample{}, &RestartingError{mp.Pid}
+	}
+
+	// Adopted process which doesn't lead its group is described with its descendants only
+	pgid := 0
+	if signalPid < 0 {
+		pgid = -signalPid
+	}
+	members := []int{}
+	if cgroup != nil {
+		members = cgroup.procs()
+	}
+	group, err := readFamilyProcStats(abs(signalPid), pgid, members)
+	if err != nil {
+		return nil, cpuSample{}, err
+	}
+	stats := &ProcessStats{
+		Pid:       mp.Pid,
+		Time:      time.Now(),
+		Processes: len(group),
+	}
+	var ticks uint64
+	for _, stat := range group {
+		ticks += stat.Utime + stat.Stime
+		stats.Rss += stat.Rss * int64(os.Getpagesize())
+		stats.Threads += stat.NumThreads
+		if fds, err := countProcFds(stat.Pid); err == nil {
+			stats.OpenFiles += fds
+		}
+		if read, written, err := readProcIO(stat.Pid); err == nil {
+			stats.ReadBytes += read
+			stats.WriteBytes += written
+		}
+	}
+	return stats, cpuSample{stats.Time, ticks}, nil
+}
+
+// Computes cpu usage between the two samples
+func cpuPercent(prev cpuSample, sample cpuSample) float64 {
+	// cpu time of the processes which finished since the previous sample is lost
+	elapsed := sample.time.Sub(prev.time).Seconds()
+	if elapsed <= 0 || sample.ticks < prev.ticks {
+		return 0
+	}
+	return float64(sample.ticks-prev.ticks) / clockTicks / elapsed * 100
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+// Periodically publishes process_stats events while the process is alive,
+// the stats are collected only if there are subscribers interested in them
+func (mp *MachineProcess) publishStats() {
+	if statsPeriodInSecondsFlag <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(statsPeriodInSecondsFlag) * time.Second)
+	defer ticker.Stop()
+
+	// The published stats describe the cpu usage since the previous published stats
+	// or since the start of the current run, the baseline is not shared with the requested stats
+	var prev *cpuSample
+	for range ticker.C {
+		if !mp.hasSubscriber(StatsBit) {
+			mp.mutex.RLock()
+			alive := mp.Alive
+			mp.mutex.RUnlock()
+			if !alive {
+				return
+			}
+			continue
+		}
+		stats, sample, err := mp.collectStats()
+		if _, ok := err.(*RestartingError); ok {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		mp.mutex.RLock()
+		startTime := mp.StartTime
+		mp.mutex.RUnlock()
+		if prev == nil || prev.time.Before(startTime) {
+			prev = &cpuSample{time: startTime}
+		}
+		stats.CpuPercent = cpuPercent(*prev, sample)
+		prev = &sample
+		mp.notifySubs(op.NewEvent(ProcessStatsEventType, stats, stats.Time), StatsBit)
+	}
+}
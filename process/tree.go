@@ -0,0 +1,86 @@
+package process
+
+import (
+	"time"
+)
+
+// Describes a native process and its descendants
+type ProcessTreeNode struct {
+	// The native(OS) pid of the process
+	NativePid int `json:"nativePid"`
+
+	// The native pid of the parent process
+	Ppid int `json:"ppid"`
+
+	// The process command line arguments, empty for zombies
+	Argv []string `json:"argv"`
+
+	// The name of the process executable
+	Name string `json:"name"`
+
+	// The process state e.g. 'R' running, 'S' sleeping, 'T' stopped, 'Z' zombie
+	State string `json:"state"`
+
+	// When the process was started
+	StartTime time.Time `json:"startTime"`
+
+	// Direct children of the process
+	Children []*ProcessTreeNode `json:"children"`
+}
+
+// Reads the tree of the native processes which root is
+// the native process started by this machine process.
+// Returns NotAliveError if the process is dead and RestartingError if it is waiting to be relaunched
+func (mp *MachineProcess) Tree() (*ProcessTreeNode, error) {
+	mp.mutex.RLock()
+	alive, restarting, nativePid := mp.Alive, mp.restarting, mp.NativePid
+	mp.mutex.RUnlock()
+	if !alive {
+		return nil, &NotAliveError{mp.Pid}
+	}
+	if restarting {
+		return nil, &RestartingError{mp.Pid}
+	}
+
+	bootTime, err := readBootTime()
+	if err != nil {
+		return nil, err
+	}
+	all, err := readAllProcStats()
+	if err != nil {
+		return nil, err
+	}
+
+	var root *procStat
+	children := make(map[int][]*procStat)
+	for _, stat := range all {
+		children[stat.Ppid] = append(children[stat.Ppid], stat)
+		if stat.Pid == nativePid {
+			root = stat
+		}
+	}
+	if root == nil {
+		return nil, &NotAliveError{mp.Pid}
+	}
+	return newTreeNode(root, children, bootTime), nil
+}
+
+func newTreeNode(stat *procStat, children map[int][]*procStat, bootTime time.Time) *ProcessTreeNode {
+	argv, err := readProcCmdline(stat.Pid)
+	if err != nil {
+		argv = []string{}
+	}
+	node := &ProcessTreeNode{
+		NativePid: stat.Pid,
+		Ppid:      stat.Ppid,
+		Argv:      argv,
+		Name:      stat.Comm,
+		State:     stat.State,
+		StartTime: procStartTime(bootTime, stat.StartTime),
+		Children:  []*ProcessTreeNode{},
+	}
+	for _, child := range children[stat.Pid] {
+		node.Children = append(node.Children, newTreeNode(child, children, bootTime))
+	}
+	return node
+}
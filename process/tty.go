@@ -0,0 +1,106 @@
+package process
+
+import (
+	"fmt"
+	"github.com/eclipse/che-lib/pty"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const (
+	// The size of the terminal when the process is started
+	DefaultTtyCols = 80
+	DefaultTtyRows = 24
+
+	// The character which the terminal interprets as the end of the input(Ctrl-D)
+	ttyEOF = 0x04
+)
+
+// Returned when the terminal operation is requested for the process which is not run in the terminal
+type NoTtyError struct {
+	Pid uint64
+}
+
+func (err *NoTtyError) Error() string {
+	return fmt.Sprintf("Process with id '%d' is not run in a terminal", err.Pid)
+}
+
+// Reads the output of the pseudo-terminal, EIO which is
+// returned when the terminal is closed is treated as EOF
+type ptyReader struct {
+	pty *os.File
+}
+
+func (r *ptyReader) Read(p []byte) (int, error) {
+	n, err := r.pty.Read(p)
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EIO {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Writes the input to the pseudo-terminal, closing the input sends
+// the end of the input character instead of closing the terminal
+type ptyWriter struct {
+	pty *os.File
+}
+
+func (w *ptyWriter) Write(p []byte) (int, error) {
+	return w.pty.Write(p)
+}
+
+func (w *ptyWriter) Close() error {
+	_, err := w.pty.Write([]byte{ttyEOF})
+	return err
+}
+
+// Opens the pseudo-terminal and makes it the standard input, output
+// and the controlling terminal of the command. Returns the terminal master
+// and the slave which should be closed as soon as the command is started
+func openTty(cmd *exec.Cmd) (*os.File, *os.File, error) {
+	master, slave, err := pty.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pty.Setsize(master, DefaultTtyRows, DefaultTtyCols); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, err
+	}
+
+	// Lines written to the terminal should end with '\n' not '\r\n' in the logs
+	disableOutputProcessing(slave)
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr.Setctty = true
+	return master, slave, nil
+}
+
+func closeTty(tty *os.File) {
+	if tty != nil {
+		tty.Close()
+	}
+}
+
+// Changes the size of the process terminal.
+// Returns NotAliveError if the process is dead and RestartingError if it is waiting to be relaunched
+func (mp *MachineProcess) Resize(cols uint16, rows uint16) error {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+	if !mp.Alive {
+		return &NotAliveError{mp.Pid}
+	}
+	if !mp.source.Tty {
+		return &NoTtyError{mp.Pid}
+	}
+	if mp.tty == nil {
+		// The process is waiting for the restart, the new terminal is
+		// created with the default size, so the resize is not possible
+		return &RestartingError{mp.Pid}
+	}
+	return pty.Setsize(mp.tty, rows, cols)
+}
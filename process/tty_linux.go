@@ -0,0 +1,17 @@
+package process
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Disables output processing of the terminal, so '\n' is not translated to '\r\n'
+func disableOutputProcessing(tty *os.File) {
+	var termios syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+		return
+	}
+	termios.Oflag &^= syscall.OPOST
+	syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&termios)))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package process
+
+import (
+	"os"
+)
+
+// Output processing is left as is, so lines end with '\r\n'
+func disableOutputProcessing(tty *os.File) {
+}
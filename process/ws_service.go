@@ -5,19 +5,37 @@ import (
 	"errors"
 	"fmt"
 	"github.com/evoevodin/machine-agent/op"
-	"math"
+	"strconv"
+	"syscall"
 	"time"
 )
 
 const (
 	ProcessStartOp            = "process.start"
+	ProcessAdoptOp            = "process.adopt"
 	ProcessKillOp             = "process.kill"
 	ProcessSubscribeOp        = "process.subscribe"
 	ProcessUnsubscribeOp      = "process.unsubscribe"
 	ProcessUpdateSubscriberOp = "process.updateSubscriber"
 	ProcessGetLogsOp          = "process.getLogs"
-
-	NoSuchProcessErrorCode = 20000
+	ProcessSearchLogsOp       = "process.searchLogs"
+	ProcessInputOp            = "process.input"
+	ProcessCloseInputOp       = "process.closeInput"
+	ProcessSuspendOp          = "process.suspend"
+	ProcessResumeOp           = "process.resume"
+	ProcessResizeOp           = "process.resize"
+	ProcessStatsOp            = "process.stats"
+	ProcessTreeOp             = "process.tree"
+	ProcessKeepOp             = "process.keep"
+	ProcessDiscardOp          = "process.discard"
+	ProcessCleanupOp          = "process.cleanup"
+
+	NoSuchProcessErrorCode      = 20000
+	ProcessNotAliveErrorCode    = 20001
+	ProcessAliveErrorCode       = 20002
+	ProcessRestartingErrorCode  = 20003
+	ProcessAdoptedErrorCode     = 20004
+	ProcessInputClosedErrorCode = 20005
 )
 
 var OpRoutes = op.RoutesGroup{
@@ -32,6 +50,15 @@ var OpRoutes = op.RoutesGroup{
 			},
 			startProcessCallHF,
 		},
+		{
+			ProcessAdoptOp,
+			func(body []byte) (interface{}, error) {
+				b := adoptBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			adoptProcessCallHF,
+		},
 		{
 			ProcessKillOp,
 			func(body []byte) (interface{}, error) {
@@ -77,19 +104,141 @@ var OpRoutes = op.RoutesGroup{
 			},
 			getProcessLogsCallHF,
 		},
+		{
+			ProcessSearchLogsOp,
+			func(body []byte) (interface{}, error) {
+				b := searchLogsBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			searchLogsCallHF,
+		},
+		{
+			ProcessInputOp,
+			func(body []byte) (interface{}, error) {
+				b := inputBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			inputCallHF,
+		},
+		{
+			ProcessCloseInputOp,
+			func(body []byte) (interface{}, error) {
+				b := closeInputBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			closeInputCallHF,
+		},
+		{
+			ProcessSuspendOp,
+			func(body []byte) (interface{}, error) {
+				b := pidBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			suspendCallHF,
+		},
+		{
+			ProcessResumeOp,
+			func(body []byte) (interface{}, error) {
+				b := pidBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			resumeCallHF,
+		},
+		{
+			ProcessResizeOp,
+			func(body []byte) (interface{}, error) {
+				b := resizeBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			resizeCallHF,
+		},
+		{
+			ProcessStatsOp,
+			func(body []byte) (interface{}, error) {
+				b := pidBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			statsCallHF,
+		},
+		{
+			ProcessTreeOp,
+			func(body []byte) (interface{}, error) {
+				b := pidBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			treeCallHF,
+		},
+		{
+			ProcessKeepOp,
+			func(body []byte) (interface{}, error) {
+				b := keepBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			keepCallHF,
+		},
+		{
+			ProcessDiscardOp,
+			func(body []byte) (interface{}, error) {
+				b := pidBody{}
+				err := json.Unmarshal(body, &b)
+				return b, err
+			},
+			discardCallHF,
+		},
+		{
+			ProcessCleanupOp,
+			func(body []byte) (interface{}, error) {
+				return nil, nil
+			},
+			cleanupCallHF,
+		},
 	},
 }
 
 type startBody struct {
-	Name        string `json:"name"`
-	CommandLine string `json:"commandLine"`
-	Type        string `json:"type"`
-	EventTypes  string `json:"eventTypes"`
+	Name        string            `json:"name"`
+	CommandLine string            `json:"commandLine"`
+	Type        string            `json:"type"`
+	Env         map[string]string `json:"env"`
+	EnvMode     string            `json:"envMode"`
+	WorkingDir  string            `json:"workingDir"`
+	Shell       string            `json:"shell"`
+	Argv        []string          `json:"argv"`
+	Timeout     int               `json:"timeout"`
+	Limits      *ResourceLimits   `json:"limits"`
+	Logs        *LogsLimits       `json:"logs"`
+	Keep        bool              `json:"keep"`
+	Secrets     *Secrets          `json:"secrets"`
+	Restart     *RestartPolicy    `json:"restart"`
+	Readiness   *ReadinessProbe   `json:"readiness"`
+	Tty         bool              `json:"tty"`
+	User        string            `json:"user"`
+	Group       string            `json:"group"`
+	Groups      []string          `json:"groups"`
+	EventTypes  string            `json:"eventTypes"`
+}
+
+type adoptBody struct {
+	NativePid  int    `json:"nativePid"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	EventTypes string `json:"eventTypes"`
 }
 
 type killBody struct {
-	Pid       uint64 `json:"pid"`
-	NativePid uint64 `json:"nativePid"`
+	Pid         uint64 `json:"pid"`
+	NativePid   uint64 `json:"nativePid"`
+	Signal      string `json:"signal"`
+	GracePeriod int    `json:"gracePeriod"`
 }
 
 type subscribeBody struct {
@@ -113,6 +262,11 @@ type updateSubscriberBody struct {
 	EventTypes string `json:"eventTypes"`
 }
 
+type keepBody struct {
+	Pid  uint64 `json:"pid"`
+	Keep bool   `json:"keep"`
+}
+
 type processOpResult struct {
 	Pid  uint64 `json:"pid"`
 	Text string `json:"text"`
@@ -124,6 +278,41 @@ type getLogsBody struct {
 	Till  string `json:"till"`
 	Limit int    `json:"limit"`
 	Skip  int    `json:"skip"`
+	After uint64 `json:"after"`
+}
+
+type searchLogsBody struct {
+	Pid        uint64 `json:"pid"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Text       string `json:"text"`
+	Regexp     bool   `json:"regexp"`
+	IgnoreCase bool   `json:"ignoreCase"`
+	Types      string `json:"types"`
+	From       string `json:"from"`
+	Till       string `json:"till"`
+	Context    int    `json:"context"`
+	Limit      int    `json:"limit"`
+}
+
+type inputBody struct {
+	Pid      uint64 `json:"pid"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding"`
+}
+
+type closeInputBody struct {
+	Pid uint64 `json:"pid"`
+}
+
+type resizeBody struct {
+	Pid  uint64 `json:"pid"`
+	Cols uint16 `json:"cols"`
+	Rows uint16 `json:"rows"`
+}
+
+type pidBody struct {
+	Pid uint64 `json:"pid"`
 }
 
 func startProcessCallHF(body interface{}, t op.Transmitter) error {
@@ -134,6 +323,22 @@ func startProcessCallHF(body interface{}, t op.Transmitter) error {
 		Name:        startBody.Name,
 		CommandLine: startBody.CommandLine,
 		Type:        startBody.Type,
+		Env:         startBody.Env,
+		EnvMode:     startBody.EnvMode,
+		WorkingDir:  startBody.WorkingDir,
+		Shell:       startBody.Shell,
+		Argv:        startBody.Argv,
+		Timeout:     startBody.Timeout,
+		Limits:      startBody.Limits,
+		Restart:     startBody.Restart,
+		Readiness:   startBody.Readiness,
+		Logs:        startBody.Logs,
+		Keep:        startBody.Keep,
+		Secrets:     startBody.Secrets,
+		Tty:         startBody.Tty,
+		User:        startBody.User,
+		Group:       startBody.Group,
+		Groups:      startBody.Groups,
 	}
 	if err := checkCommand(&command); err != nil {
 		return op.NewArgsError(err)
@@ -158,17 +363,58 @@ func startProcessCallHF(body interface{}, t op.Transmitter) error {
 	return process.Start()
 }
 
+func adoptProcessCallHF(body interface{}, t op.Transmitter) error {
+	adoptBody := body.(adoptBody)
+	subscriber := &Subscriber{
+		Id:      t.Channel().Id,
+		Mask:    parseTypes(adoptBody.EventTypes),
+		Channel: t.Channel().Events,
+	}
+	process, err := AdoptProcess(adoptBody.NativePid, adoptBody.Name, adoptBody.Type, subscriber)
+	if err != nil {
+		if _, ok := err.(*NoNativeProcessError); ok {
+			return op.NewError(err, NoSuchProcessErrorCode)
+		}
+		if _, ok := err.(*BadAdoptionError); ok {
+			return op.NewArgsError(err)
+		}
+		if _, ok := err.(*AdoptedError); ok {
+			return op.NewError(err, ProcessAdoptedErrorCode)
+		}
+		return err
+	}
+	t.Send(process)
+	return nil
+}
+
 func killProcessCallHF(body interface{}, t op.Transmitter) error {
 	killBody := body.(killBody)
-	p, ok := Get(killBody.Pid)
-	if !ok {
+
+	// Native pid is used only if the pid is not specified
+	var p *MachineProcess
+	var ok bool
+	if killBody.Pid == 0 && killBody.NativePid != 0 {
+		p, ok = GetByNativePid(int(killBody.NativePid))
+		if !ok {
+			m := fmt.Sprintf("No alive process with native id '%d'", killBody.NativePid)
+			return op.NewError(errors.New(m), NoSuchProcessErrorCode)
+		}
+	} else if p, ok = Get(killBody.Pid); !ok {
 		return newNoSuchProcessError(killBody.Pid)
 	}
-	if err := p.Kill(); err != nil {
-		return err
+
+	sig, err := parseSignal(killBody.Signal, syscall.SIGKILL)
+	if err != nil {
+		return op.NewArgsError(err)
+	}
+	if killBody.GracePeriod < 0 {
+		return op.NewArgsError(errors.New("Required 'gracePeriod' to be >= 0"))
+	}
+	if err := p.KillWithSignal(sig, time.Duration(killBody.GracePeriod)*time.Second); err != nil {
+		return asOpError(err)
 	}
 	t.Send(&processOpResult{
-		Pid:  killBody.Pid,
+		Pid:  p.Pid,
 		Text: "Successfully killed",
 	})
 	return nil
@@ -192,17 +438,24 @@ func subscribeCallHF(body interface{}, t op.Transmitter) error {
 		return p.AddSubscriber(subscriber)
 	}
 
-	after, err := time.Parse(DateTimeFormat, subscribeBody.After)
-	if err != nil {
-		return op.NewArgsError(errors.New("Bad format of 'after', " + err.Error()))
-	}
-	if err := p.RestoreSubscriber(subscriber, after); err != nil {
-		return err
+	// The 'after' is either the sequence number of the log line or the time
+	if seq, err := strconv.ParseUint(subscribeBody.After, 10, 64); err == nil {
+		if err := p.RestoreSubscriberAfterSeq(subscriber, seq); err != nil {
+			return err
+		}
+	} else {
+		after, err := time.Parse(DateTimeFormat, subscribeBody.After)
+		if err != nil {
+			return op.NewArgsError(errors.New("Bad format of 'after', " + err.Error()))
+		}
+		if err := p.RestoreSubscriber(subscriber, after); err != nil {
+			return err
+		}
 	}
 	t.Send(&subscribeResult{
 		Pid:        p.Pid,
 		EventTypes: subscribeBody.EventTypes,
-		Text:       "Successfully unsubscribed",
+		Text:       "Successfully subscribed",
 	})
 	return nil
 }
@@ -211,7 +464,7 @@ func unsubscribeCallHF(call interface{}, t op.Transmitter) error {
 	unsubscribeBody := call.(unsubscribeBody)
 	p, ok := Get(unsubscribeBody.Pid)
 	if !ok {
-		return errors.New(fmt.Sprintf("Process with id '%s' doesn't exist", unsubscribeBody.Pid))
+		return errors.New(fmt.Sprintf("Process with id '%d' doesn't exist", unsubscribeBody.Pid))
 	}
 	p.RemoveSubscriber(t.Channel().Id)
 	t.Send(&processOpResult{
@@ -259,35 +512,238 @@ func getProcessLogsCallHF(body interface{}, t op.Transmitter) error {
 		return op.NewArgsError(errors.New("Bad format of 'till', " + err.Error()))
 	}
 
-	logs, err := p.ReadLogs(from, till)
-	if err != nil {
-		return err
-	}
-
 	limit := DefaultLogsLimit
 	if args.Limit != 0 {
-		if limit < 1 {
+		if args.Limit < 1 {
 			return op.NewArgsError(errors.New("Required 'limit' to be > 0"))
 		}
 		limit = args.Limit
 	}
 
-	skip := 0
-	if args.Skip != 0 {
-		if skip < 0 {
-			return op.NewArgsError(errors.New("Required 'skip' to be >= 0"))
+	if args.Skip < 0 {
+		return op.NewArgsError(errors.New("Required 'skip' to be >= 0"))
+	}
+
+	logs, err := p.ReadLastLogs(from, till, args.After, DefaultMask, limit, args.Skip)
+	if err != nil {
+		return err
+	}
+	t.Send(logs)
+	return nil
+}
+
+func searchLogsCallHF(body interface{}, t op.Transmitter) error {
+	args := body.(searchLogsBody)
+	from, err := parseTime(args.From, time.Time{})
+	if err != nil {
+		return op.NewArgsError(errors.New("Bad format of 'from', " + err.Error()))
+	}
+	till, err := parseTime(args.Till, time.Now())
+	if err != nil {
+		return op.NewArgsError(errors.New("Bad format of 'till', " + err.Error()))
+	}
+	query := &LogsQuery{
+		Text:       args.Text,
+		Regexp:     args.Regexp,
+		IgnoreCase: args.IgnoreCase,
+		Mask:       parseTypes(args.Types),
+		From:       from,
+		Till:       till,
+		Context:    args.Context,
+		Limit:      args.Limit,
+	}
+	if query.Limit == 0 {
+		query.Limit = DefaultLogsLimit
+	}
+
+	// Search across all the processes if the process is not specified
+	var matches []*LogsMatch
+	if args.Pid == 0 {
+		matches, err = SearchProcessesLogs(args.Name, args.Type, query)
+	} else {
+		p, ok := Get(args.Pid)
+		if !ok {
+			return newNoSuchProcessError(args.Pid)
 		}
-		skip = args.Skip
+		matches, err = p.SearchLogs(query)
+	}
+	if err != nil {
+		return asOpError(err)
+	}
+	t.Send(matches)
+	return nil
+}
+
+func inputCallHF(body interface{}, t op.Transmitter) error {
+	inputBody := body.(inputBody)
+	p, ok := Get(inputBody.Pid)
+	if !ok {
+		return newNoSuchProcessError(inputBody.Pid)
+	}
+	data, err := decodeInput(inputBody.Text, inputBody.Encoding)
+	if err != nil {
+		return op.NewArgsError(err)
+	}
+	if err := p.WriteInput(data); err != nil {
+		return asOpError(err)
+	}
+	t.Send(&processOpResult{
+		Pid:  p.Pid,
+		Text: "Successfully written",
+	})
+	return nil
+}
+
+func closeInputCallHF(body interface{}, t op.Transmitter) error {
+	closeInputBody := body.(closeInputBody)
+	p, ok := Get(closeInputBody.Pid)
+	if !ok {
+		return newNoSuchProcessError(closeInputBody.Pid)
+	}
+	if err := p.CloseInput(); err != nil {
+		return asOpError(err)
+	}
+	t.Send(&processOpResult{
+		Pid:  p.Pid,
+		Text: "Input successfully closed",
+	})
+	return nil
+}
+
+func suspendCallHF(body interface{}, t op.Transmitter) error {
+	pidBody := body.(pidBody)
+	p, ok := Get(pidBody.Pid)
+	if !ok {
+		return newNoSuchProcessError(pidBody.Pid)
+	}
+	if err := p.Suspend(); err != nil {
+		return asOpError(err)
+	}
+	t.Send(&processOpResult{
+		Pid:  p.Pid,
+		Text: "Successfully suspended",
+	})
+	return nil
+}
+
+func resumeCallHF(body interface{}, t op.Transmitter) error {
+	pidBody := body.(pidBody)
+	p, ok := Get(pidBody.Pid)
+	if !ok {
+		return newNoSuchProcessError(pidBody.Pid)
 	}
+	if err := p.Resume(); err != nil {
+		return asOpError(err)
+	}
+	t.Send(&processOpResult{
+		Pid:  p.Pid,
+		Text: "Successfully resumed",
+	})
+	return nil
+}
 
-	len := len(logs)
-	fromIdx := int(math.Max(float64(len-limit-skip), 0))
-	toIdx := len - int(math.Min(float64(skip), float64(len)))
+func resizeCallHF(body interface{}, t op.Transmitter) error {
+	resizeBody := body.(resizeBody)
+	p, ok := Get(resizeBody.Pid)
+	if !ok {
+		return newNoSuchProcessError(resizeBody.Pid)
+	}
+	if resizeBody.Cols == 0 || resizeBody.Rows == 0 {
+		return op.NewArgsError(errors.New("Required 'cols' and 'rows' to be > 0"))
+	}
+	if err := p.Resize(resizeBody.Cols, resizeBody.Rows); err != nil {
+		return asOpError(err)
+	}
+	t.Send(&processOpResult{
+		Pid:  p.Pid,
+		Text: "Successfully resized",
+	})
+	return nil
+}
 
-	t.Send(logs[fromIdx:toIdx])
+func statsCallHF(body interface{}, t op.Transmitter) error {
+	pidBody := body.(pidBody)
+	p, ok := Get(pidBody.Pid)
+	if !ok {
+		return newNoSuchProcessError(pidBody.Pid)
+	}
+	stats, err := p.Stats()
+	if err != nil {
+		return asOpError(err)
+	}
+	t.Send(stats)
+	return nil
+}
+
+func treeCallHF(body interface{}, t op.Transmitter) error {
+	pidBody := body.(pidBody)
+	p, ok := Get(pidBody.Pid)
+	if !ok {
+		return newNoSuchProcessError(pidBody.Pid)
+	}
+	tree, err := p.Tree()
+	if err != nil {
+		return asOpError(err)
+	}
+	t.Send(tree)
+	return nil
+}
+
+func keepCallHF(body interface{}, t op.Transmitter) error {
+	keepBody := body.(keepBody)
+	p, ok := Get(keepBody.Pid)
+	if !ok {
+		return newNoSuchProcessError(keepBody.Pid)
+	}
+	p.SetKeep(keepBody.Keep)
+	t.Send(p)
+	return nil
+}
+
+func discardCallHF(body interface{}, t op.Transmitter) error {
+	pidBody := body.(pidBody)
+	p, ok := Get(pidBody.Pid)
+	if !ok {
+		return newNoSuchProcessError(pidBody.Pid)
+	}
+	if _, err := p.Discard(); err != nil {
+		return asOpError(err)
+	}
+	t.Send(&processOpResult{
+		Pid:  p.Pid,
+		Text: "Successfully discarded",
+	})
+	return nil
+}
+
+func cleanupCallHF(body interface{}, t op.Transmitter) error {
+	t.Send(NewCleaner().Cleanup())
 	return nil
 }
 
 func newNoSuchProcessError(pid uint64) op.Error {
 	return op.NewError(errors.New(fmt.Sprintf("No process with id '%d'", pid)), NoSuchProcessErrorCode)
 }
+
+// Converts process errors to an appropriate operation errors
+func asOpError(err error) error {
+	if _, ok := err.(*NotAliveError); ok {
+		return op.NewError(err, ProcessNotAliveErrorCode)
+	}
+	if _, ok := err.(*AliveError); ok {
+		return op.NewError(err, ProcessAliveErrorCode)
+	}
+	if _, ok := err.(*RestartingError); ok {
+		return op.NewError(err, ProcessRestartingErrorCode)
+	}
+	if _, ok := err.(*InputClosedError); ok {
+		return op.NewError(err, ProcessInputClosedErrorCode)
+	}
+	if _, ok := err.(*NoTtyError); ok {
+		return op.NewArgsError(err)
+	}
+	if _, ok := err.(*BadLogsQueryError); ok {
+		return op.NewArgsError(err)
+	}
+	return err
+}